@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+/**
+	Debug
+ */
+type debugStack struct {
+	Id              string        `json:"id"`
+	EnvironmentName string        `json:"environmentName"`
+	Metrics         []debugMetric `json:"metrics"`
+}
+
+type debugMetric struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// debugAuthorized tells whether a request carries the bearer token or the basic auth credentials of the debug endpoints.
+func debugAuthorized(req *http.Request) bool {
+	if len(debugAuthToken) != 0 && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+debugAuthToken)) == 1 {
+		return true
+	}
+
+	if user, password, ok := req.BasicAuth(); ok && len(debugAuthUser) != 0 && len(debugAuthPassword) != 0 {
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(debugAuthUser))
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(debugAuthPassword))
+		return userMatch&passwordMatch == 1
+	}
+
+	return false
+}
+
+// requireDebugAuth answers 401 to the requests which are not authorized for the debug endpoints.
+func requireDebugAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !debugAuthorized(req) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rancher_exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// serveDebugStack fetches one stack with its services and instances on demand, the same as a scrape does but on
+// a throwaway scrape, and answers the metrics of it. The metrics of the scrapes are put back as they were afterwards.
+func (r *rancherExporter) serveDebugStack(w http.ResponseWriter, req *http.Request) {
+	stackId := req.URL.Query().Get("id")
+	if len(stackId) == 0 {
+		http.Error(w, "id must be set and non-empty", http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	if scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, scrapeTimeout)
+		defer cancel()
+	}
+	hc := r.api.withContext(ctx)
+
+	// look the stack up in the environments in turn, a hidden system stack is not found
+	var project *rancherProject
+	var stackBytes []byte
+	for _, candidate := range r.projects {
+		stackAddress := cattleURL + "/projects/" + candidate.id + "/stacks/" + url.PathEscape(stackId)
+		respBytes, err := hc.withEnvironment(candidate.id).get(stackAddress)
+		if responseStatus(err) == http.StatusNotFound {
+			continue
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		if stackSystem, _ := jsonparser.GetBoolean(respBytes, "system"); hideSys && stackSystem {
+			continue
+		}
+		project, stackBytes = candidate, respBytes
+		break
+	}
+	if project == nil {
+		http.Error(w, "stack "+stackId+" not found", http.StatusNotFound)
+		return
+	}
+
+	// the metric vectors are shared with the scrapes, keep the scrapes out until they are put back
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	vecs := syncVecs()
+	scraped := make([][]prometheus.Metric, len(vecs))
+	registry := prometheus.NewRegistry()
+	for i, vec := range vecs {
+		scraped[i] = gatherMetrics(vec)
+		vec.Reset()
+		registry.MustRegister(vec)
+	}
+	defer func() {
+		for i, vec := range vecs {
+			vec.Reset()
+			restoreMetrics(vec, scraped[i])
+		}
+	}()
+
+	s := newSyncScrape(hc.withEnvironment(project.id), ctx, project)
+	stackId, stackName := r.syncStack(stackBytes, s)
+	s.eachData("services", stackServicesAddress(url.PathEscape(stackId)), func(serviceBytes []byte) {
+		serviceId, _ := jsonparser.GetString(serviceBytes, "id")
+		r.syncService(stackId, stackName, serviceBytes, s, func(cb func(instanceBytes []byte)) {
+			s.eachData("instances", serviceInstancesAddress(serviceId), cb)
+		})
+	})
+
+	if !s.errs.empty() {
+		s.errs.summary()
+		http.Error(w, "cannot fetch all the services and instances of stack "+stackId, http.StatusBadGateway)
+		return
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stack := debugStack{
+		Id:              stackId,
+		EnvironmentName: project.name,
+		Metrics:         []debugMetric{},
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string, len(metric.GetLabel()))
+			for _, labelPair := range metric.GetLabel() {
+				labels[labelPair.GetName()] = labelPair.GetValue()
+			}
+			stack.Metrics = append(stack.Metrics, debugMetric{family.GetName(), labels, metric.GetGauge().GetValue()})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stack)
+}
+
+// restoreMetrics sets the gauges of the vector to the values of the metrics gathered from it.
+func restoreMetrics(vec *prometheus.GaugeVec, metrics []prometheus.Metric) {
+	for _, metric := range metrics {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			continue
+		}
+
+		labels := make(prometheus.Labels, len(pb.GetLabel()))
+		for _, labelPair := range pb.GetLabel() {
+			labels[labelPair.GetName()] = labelPair.GetValue()
+		}
+		vec.With(labels).Set(pb.GetGauge().GetValue())
+	}
+}
@@ -1,26 +1,45 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/buger/jsonparser"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/thxcode/rancher1.x-restarting-controller/pkg/utils"
+	"golang.org/x/time/rate"
 )
 
 const (
 	// Used to prepand Prometheus metrics created by this exporter.
 	namespace  = "rancher"
 	specialTag = "__rancher__"
+
+	// Used to skip the removed instances on listing.
+	removedInstancesFilter = "&state_ne=removed&state_ne=purged"
 )
 
 var (
@@ -198,6 +217,140 @@ var (
 		Help:      "Current total number of the unhealthy or error bootstrap instances in Rancher",
 	}, []string{"environment_name", "stack_name", "service_name", "name"})
 
+	// removed counter of stack, service
+	extendingTotalStackRemovals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stack_removed_total",
+		Help:      "Current total number of the removed stacks in Rancher",
+	}, []string{"environment_name"})
+
+	extendingTotalServiceRemovals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_removed_total",
+		Help:      "Current total number of the removed services in Rancher",
+	}, []string{"environment_name"})
+
+	// data age gauge
+	extendingInstanceDataAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_data_age_seconds",
+		Help:      "The seconds since instances in Rancher were updated by Rancher itself",
+	}, []string{"environment_name", "stack_name", "service_name", "name", "system", "type"})
+
+	// restart gauge
+	extendingInstanceRestartCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_restart_count",
+		Help:      "The restarts of instances in Rancher since created, derived from their start count",
+	}, []string{"environment_name", "stack_name", "service_name", "name", "system", "type"})
+
+	// never running gauge
+	extendingInstanceNeverRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_never_running",
+		Help:      "Whether instances in Rancher have never been running since created longer than the grace period ago",
+	}, []string{"environment_name", "stack_name", "service_name", "name", "system", "type"})
+
+	// object gauge
+	extendingProjectsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "projects_total",
+		Help:      "Current number of the environments collected from Rancher",
+	})
+
+	extendingStacksTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stacks_total",
+		Help:      "Current number of the stacks in Rancher",
+	}, []string{"environment_name"})
+
+	extendingServicesTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "services_total",
+		Help:      "Current number of the services in Rancher",
+	}, []string{"environment_name"})
+
+	extendingInstancesTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instances_total",
+		Help:      "Current number of the instances in Rancher",
+	}, []string{"environment_name"})
+
+	// system gauge
+	extendingSystemObjectCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "system_object_count",
+		Help:      "Current number of the system stacks, services and instances in Rancher",
+	}, []string{"environment_name", "type"})
+
+	extendingSystemObjectRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "system_object_ratio",
+		Help:      "Current ratio of the system stacks, services and instances to all of them in Rancher",
+	}, []string{"environment_name", "type"})
+
+	// member gauge
+	extendingEnvironmentMemberCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "environment_member_count",
+		Help:      "Current number of the members of the environment in Rancher",
+	}, []string{"environment_name"})
+
+	// status gauge
+	extendingServiceStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_status",
+		Help:      "The combined status of services in Rancher, 0 is down, 1 is degraded and 2 is healthy",
+	}, []string{"environment_name", "stack_name", "name", "system"})
+
+	// running gauge, labeled the same as the scale to compare them
+	extendingServiceInstancesRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_instances_running",
+		Help:      "Current number of the running instances of services in Rancher",
+	}, []string{"name", "stack_name", "system"})
+
+	// down gauge
+	extendingServiceDown = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_down",
+		Help:      "Whether services in Rancher have a positive scale but no running instance",
+	}, []string{"environment_name", "stack_name", "name", "system"})
+
+	// registering gauge
+	extendingServiceRegistering = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_registering",
+		Help:      "Whether services in Rancher are in the registering state",
+	}, []string{"environment_name", "stack_name", "name", "system"})
+
+	// startup average gauge
+	extendingServiceStartupMsEMA = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_startup_ms_ema",
+		Help:      "The exponential moving average of the startup milliseconds of the instances of services in Rancher",
+	}, []string{"environment_name", "stack_name", "name", "system"})
+
+	extendingServiceStartupSecondsEMA = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_startup_seconds_ema",
+		Help:      "The exponential moving average of the startup seconds of the instances of services in Rancher",
+	}, []string{"environment_name", "stack_name", "name", "system"})
+
+	// owner gauge
+	extendingServiceOwnerInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_owner_info",
+		Help:      "The owner of services in Rancher read from the owner label",
+	}, []string{"environment_name", "stack_name", "name", "owner"})
+
+	// endpoint gauge
+	extendingServiceEndpointReachable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_endpoint_reachable",
+		Help:      "Whether the public endpoint of services in Rancher accepts TCP connections",
+	}, []string{"environment_name", "stack_name", "name", "ip", "port"})
+
 	// startup gauge
 	extendingInstanceBootstrapMsCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -205,6 +358,57 @@ var (
 		Help:      "The bootstrap milliseconds of instances in Rancher",
 	}, []string{"environment_name", "stack_name", "service_name", "name", "system", "type"})
 
+	extendingInstanceBootstrapSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "instance_bootstrap_seconds",
+		Help:      "The bootstrap seconds of instances in Rancher",
+	}, []string{"environment_name", "stack_name", "service_name", "name", "system", "type"})
+
+	// stuck gauge
+	extendingStackStuck = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stack_stuck",
+		Help:      "Whether stacks in Rancher stay in a transitional state longer than the stuck threshold",
+	}, []string{"environment_name", "stack_name"})
+
+	// host capacity gauges
+	extendingHostCPUCores = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_cpu_cores",
+		Help:      "The CPU cores of hosts as reported by the Rancher agents",
+	}, []string{"id", "name"})
+
+	extendingHostMemoryBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_memory_bytes",
+		Help:      "The total memory bytes of hosts as reported by the Rancher agents",
+	}, []string{"id", "name"})
+
+	// host labels gauge, redefined with the host label keys on startup
+	extendingHostLabels = newHostLabelsVec(nil)
+
+	// self link gauge
+	extendingServiceSelfLink = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_self_link",
+		Help:      "The self link of services in the Rancher API, the value is always 1",
+	}, []string{"environment_name", "stack_name", "name", "link"})
+
+	// load balancer backends gauge
+	extendingLBHealthyBackends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "healthy_backends",
+		Help:      "Current number of the running and healthy instances of the services targeted by load balancers",
+	}, []string{"environment_name", "stack_name", "name", "system"})
+
+	extendingLBTotalBackends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "lb",
+		Name:      "total_backends",
+		Help:      "Current number of the instances of the services targeted by load balancers",
+	}, []string{"environment_name", "stack_name", "name", "system"})
+
 	// heartbeat
 	extendingStackHeartbeat = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -223,609 +427,3002 @@ var (
 		Name:      "instance_heartbeat",
 		Help:      "The heartbeat of instances in Rancher",
 	}, []string{"environment_name", "stack_name", "service_name", "name", "system", "type"})
+
+	/**
+		Exporter
+	 */
+
+	exporterPushErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "push_errors_total",
+		Help:      "Current total number of the failed pushes to Pushgateway",
+	})
+
+	exporterServiceFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "service_fetch_duration_seconds",
+		Help:      "The seconds of fetching the instances of a service from Rancher",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"system"})
+
+	exporterScrapeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scrape_duration_seconds",
+		Help:      "The seconds of a whole fetch from Rancher, the hosts and the members included",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	})
+
+	exporterEnvironmentFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "environment_fetch_duration_seconds",
+		Help:      "The seconds of fetching the stacks, services and instances of an environment from Rancher",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"environment_name"})
+
+	exporterDecodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "decode_errors_total",
+		Help:      "Current total number of the Rancher API responses which are not a collection",
+	}, []string{"endpoint"})
+
+	exporterScrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scrape_errors_total",
+		Help:      "Current total number of the failed requests to Rancher API while fetching the resources of an environment",
+	}, []string{"environment_name", "endpoint"})
+
+	exporterAPIBytesRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "api_bytes_read_total",
+		Help:      "Current total number of the bytes read from the Rancher API response bodies as they come on the wire",
+	})
+
+	exporterTruncatedLabels = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "truncated_labels_total",
+		Help:      "Current total number of the label values truncated to the maximum label length",
+	})
+
+	exporterFirstPageDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "first_page_duration_seconds",
+		Help:      "The seconds of fetching the first page of the Rancher API listings",
+	})
+
+	exporterSubsequentPageDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "subsequent_page_duration_seconds",
+		Help:      "The seconds of fetching the pages after the first of the Rancher API listings",
+	})
+
+	exporterRateLimitWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "rate_limit_wait_seconds",
+		Help:      "The seconds of the requests to Rancher API waiting for the rate limiter",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	exporterRateLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "rate_limit_requests_per_second",
+		Help:      "The requests per second allowed to Rancher API by the rate limiter, 0 means unlimited",
+	})
+
+	exporterRateLimitBurst = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "rate_limit_burst",
+		Help:      "The burst of the requests allowed to Rancher API by the rate limiter, 0 means unlimited",
+	})
+
+	exporterAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "The seconds of the requests to Rancher API, every retry is observed on its own",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"resource"})
+
+	exporterAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Current total number of the requests to Rancher API by the class of their status",
+	}, []string{"resource", "code"})
+
+	exporterScrapeSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "scrape_success",
+		Help:      "Whether the last fetch from Rancher succeeded without any error",
+	})
+
+	exporterRancherUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "up",
+		Help:      "Whether the last fetch reached Rancher API and listed the projects",
+	}, []string{"server"})
+
+	exporterScrapeInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "scrape_in_flight_seconds",
+		Help:      "The seconds the running fetch from Rancher has taken so far, 0 when idle",
+	})
+
+	exporterScrapeInterval = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "scrape_interval_seconds",
+		Help:      "The effective minimum seconds between two fetches from Rancher, 0 means every scrape fetches",
+	})
+
+	exporterScrapeCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "scrape_cache_hits_total",
+		Help:      "Current total number of the scrapes served from the last fetch within the minimum scrape interval",
+	})
+
+	exporterScrapeCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "scrape_cache_misses_total",
+		Help:      "Current total number of the scrapes fetching from Rancher",
+	})
+
+	exporterHideSystem = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "hide_system",
+		Help:      "Whether the system stacks, services and instances are hidden",
+	})
+
+	exporterStartTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "start_time_seconds",
+		Help:      "The start time of the exporter since unix epoch in seconds",
+	})
+
+	exporterAPICompatible = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "api_compatible",
+		Help:      "Whether the Rancher API looks like a Rancher 1.x cattle API",
+	})
+
+	exporterClockSkew = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "clock_skew_seconds",
+		Help:      "The seconds the exporter clock is ahead of Rancher, estimated from the Date header of the responses",
+	})
+
+	exporterSeriesCapped = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "series_capped",
+		Help:      "Whether the last collect dropped series over the maximum total series",
+	})
+
+	exporterSeriesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "exporter",
+		Name:      "series_count",
+		Help:      "Current number of the label series of the per-object vectors on the last collect",
+	}, []string{"metric"})
+)
+
+var (
+	// Used to bound the requests to Rancher API in flight, nil means unlimited.
+	requestLimiter chan struct{}
+
+	// Used to bound the fetch goroutines of the scrapes and the initial load, nil means unlimited.
+	fetchLimiter chan struct{}
+
+	// Used to dial the public endpoints of the services.
+	dialProbe = net.DialTimeout
+
+	// Used to reach Rancher API over TLS with the custom CA or without verifying, nil means the defaults.
+	rancherTLSConfig *tls.Config
+	rancherTransport http.RoundTripper
+
+	// Used to bound the requests to Rancher API per second, nil means unlimited.
+	requestRateLimiter *rate.Limiter
+
+	// Used to estimate the clock skew once a minute at most.
+	clockSkewMutex   = &sync.Mutex{}
+	clockSkewUpdated time.Time
+
+	// Used to redact the string fields looking like secrets before logging the response bodies.
+	secretFieldPattern = regexp.MustCompile(`(?i)("[^"]*(?:secret|password|passwd|token|key|credential|publicValue)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+	// Used to pick the host labels exposed by the host labels gauge, empty means not collected.
+	hostLabelKeys []string
+
+	// Used to select the hosts to collect by their labels, nil means all the hosts.
+	hostLabelSelector map[string]string
+
+	// Used to pick the environment by its name or id, nil means the first environment of the API key.
+	environments map[string]bool
+
+	// Used to authorize the requests of an environment by its id with keys of its own, as access:secret,
+	// the environments not listed use the global credentials.
+	environmentCredentials map[string]string
+
+	// Used to filter the stacks by their names, nil means no filter.
+	stackInclude *regexp.Regexp
+	stackExclude *regexp.Regexp
+
+	// Used to map the Rancher types to the canonical type labels, nil means the raw types.
+	typeLabels map[string]string
+
+	canonicalTypes = map[string]string{
+		"stack":                "stack",
+		"service":              "service",
+		"dnsService":           "dns",
+		"externalService":      "external",
+		"loadBalancerService":  "load_balancer",
+		"networkDriverService": "network_driver",
+		"storageDriverService": "storage_driver",
+		"kubernetesService":    "kubernetes",
+		"composeService":       "compose",
+		"scalingGroup":         "scaling_group",
+		"selectorService":      "selector",
+		"launchConfig":         "launch_config",
+		"container":            "container",
+		"virtualMachine":       "virtual_machine",
+	}
 )
 
+// rancherAPI reads Rancher API, the scrapes depend on it rather than on the http client so they can run against canned responses.
+type rancherAPI interface {
+	get(address string) ([]byte, error)
+	withContext(ctx context.Context) rancherAPI
+	withEnvironment(projectId string) rancherAPI
+}
+
+// eventSource streams the resource change events of the environment, read answers false once the source is closed.
+type eventSource interface {
+	read() ([]byte, bool)
+	close()
+}
+
+// websocketEvents reads the events from the subscribe websocket of Rancher, redialing whenever the connection drops.
+type websocketEvents struct {
+	mutex  *sync.Mutex
+	conn   *websocket.Conn
+	dial   func() *websocket.Conn
+	closed bool
+}
+
+func (w *websocketEvents) read() ([]byte, bool) {
+	for {
+		w.mutex.Lock()
+		conn, closed := w.conn, w.closed
+		w.mutex.Unlock()
+		if closed {
+			return nil, false
+		}
+
+		if _, messageBytes, err := conn.ReadMessage(); err == nil {
+			return messageBytes, true
+		}
+
+		w.mutex.Lock()
+		if !w.closed {
+			utils.GetGlobalLogger().Warnln("reconnect websocket")
+			w.conn = w.dial()
+		}
+		w.mutex.Unlock()
+	}
+}
+
+func (w *websocketEvents) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.closed = true
+	w.conn.Close()
+}
+
+func newWebsocketEvents(dial func() *websocket.Conn) *websocketEvents {
+	return &websocketEvents{
+		mutex: &sync.Mutex{},
+		conn:  dial(),
+		dial:  dial,
+	}
+}
+
 type httpClient struct {
-	client *http.Client
+	client    *http.Client
+	ctx       context.Context
+	projectId string
 }
 
+// get retries the timeouts, the refused or reset connections and the 429 or 5xx responses with a jittered exponential backoff,
+// the last attempt is answered as it is.
 func (r *httpClient) get(url string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		bs, statusCode, err := r.getOnce(url)
+		if attempt >= retryMax || !retryable(statusCode, err) {
+			return bs, err
+		}
+
+		backoff := retryBackoff << uint(attempt)
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Debugf("%s failed on attempt %d, retrying in %v", url, attempt+1, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		}
+	}
+}
+
+func (r *httpClient) getOnce(url string) (_ []byte, statusCode int, err error) {
+	if requestRateLimiter != nil {
+		waitStart := time.Now()
+		if err := requestRateLimiter.Wait(r.ctx); err != nil {
+			return nil, 0, err
+		}
+		exporterRateLimitWait.Observe(time.Since(waitStart).Seconds())
+	}
+
+	if requestLimiter != nil {
+		select {
+		case requestLimiter <- struct{}{}:
+		case <-r.ctx.Done():
+			return nil, 0, r.ctx.Err()
+		}
+		defer func() {
+			<-requestLimiter
+		}()
+	}
+
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	req = req.WithContext(r.ctx)
+
+	requestStart := time.Now()
+	defer func() {
+		resource := apiResource(url)
+		exporterAPIRequestDuration.WithLabelValues(resource).Observe(time.Since(requestStart).Seconds())
+		exporterAPIRequests.WithLabelValues(resource, statusClass(statusCode)).Inc()
+	}()
 
-	req.SetBasicAuth(cattleAccessKey, cattleSecretKey)
+	req.Header.Set("Authorization", authorization(r.projectId))
+	// asking for gzip explicitly keeps the transport from decoding it, so the body is counted as it comes on the wire
+	req.Header.Set("Accept-Encoding", "gzip")
 	resp, err := r.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
+	observeClockSkew(resp.Header)
+
+	wire := &countingReader{reader: resp.Body}
+	defer func() {
+		exporterAPIBytesRead.Add(float64(wire.count))
+	}()
+
+	var body io.Reader = wire
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, resp.StatusCode, err
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
 
-	if bs, err := ioutil.ReadAll(resp.Body); err != nil {
-		return nil, err
+	if bs, err := ioutil.ReadAll(body); err != nil {
+		return nil, resp.StatusCode, err
 	} else {
-		return bs, nil
+		if logResponseBodies {
+			logResponseBody(url, bs)
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, resp.StatusCode, &statusError{resp.StatusCode, bs}
+		}
+
+		return bs, resp.StatusCode, nil
 	}
 }
 
-func newHttpClient(timeoutSeconds time.Duration) *httpClient {
-	return &httpClient{
-		&http.Client{Timeout: timeoutSeconds},
-	}
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int64
 }
 
-type buffMsg struct {
-	id            string
-	name          string
-	state         string
-	healthState   string
-	transitioning string
-	serviceName   string
-	stackName     string
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
 }
 
-/**
-	RancherExporter
- */
-type rancherExporter struct {
-	projectId     string
-	projectName   string
-	mutex         *sync.Mutex
-	websocketConn *websocket.Conn
+// apiResource names the resource of a Rancher API address by its last known collection, keeping the label bounded.
+func apiResource(address string) string {
+	link, err := url.Parse(address)
+	if err != nil {
+		return "other"
+	}
 
-	stacksBuff    chan buffMsg
-	servicesBuff  chan buffMsg
-	instancesBuff chan buffMsg
+	segments := strings.Split(strings.Trim(link.Path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		switch segments[i] {
+		case "projects", "stacks", "services", "instances", "hosts", "projectmembers":
+			return segments[i]
+		}
+	}
 
-	recreateWebsocket func() *websocket.Conn
+	return "other"
 }
 
-func (r *rancherExporter) Describe(ch chan<- *prometheus.Desc) {
-	infinityWorksStacksHealth.Describe(ch)
-	infinityWorksStacksState.Describe(ch)
-	infinityWorksServicesScale.Describe(ch)
-	infinityWorksServicesHealth.Describe(ch)
-	infinityWorksServicesState.Describe(ch)
-	infinityWorksHostsState.Describe(ch)
-	infinityWorksHostAgentsState.Describe(ch)
-
-	extendingTotalStackInitializations.Describe(ch)
-	extendingTotalSuccessStackInitialization.Describe(ch)
-	extendingTotalErrorStackInitialization.Describe(ch)
-	extendingTotalServiceInitializations.Describe(ch)
-	extendingTotalSuccessServiceInitialization.Describe(ch)
-	extendingTotalErrorServiceInitialization.Describe(ch)
-	extendingTotalInstanceInitializations.Describe(ch)
-	extendingTotalSuccessInstanceInitialization.Describe(ch)
-	extendingTotalErrorInstanceInitialization.Describe(ch)
+// statusClass groups the status of a request by its first digit, "error" when it failed before any response.
+func statusClass(statusCode int) string {
+	if statusCode == 0 {
+		return "error"
+	}
 
-	extendingTotalStackBootstraps.Describe(ch)
-	extendingTotalSuccessStackBootstrap.Describe(ch)
-	extendingTotalErrorStackBootstrap.Describe(ch)
-	extendingTotalServiceBootstraps.Describe(ch)
-	extendingTotalSuccessServiceBootstrap.Describe(ch)
-	extendingTotalErrorServiceBootstrap.Describe(ch)
-	extendingTotalInstanceBootstraps.Describe(ch)
-	extendingTotalSuccessInstanceBootstrap.Describe(ch)
-	extendingTotalErrorInstanceBootstrap.Describe(ch)
-	extendingInstanceBootstrapMsCost.Describe(ch)
+	return strconv.Itoa(statusCode/100) + "xx"
+}
 
-	extendingInstanceHeartbeat.Describe(ch)
-	extendingServiceHeartbeat.Describe(ch)
-	extendingStackHeartbeat.Describe(ch)
+// statusError is a response of Rancher API out of 2xx, e.g. a 401 of wrong keys, the body tells the Rancher error apart.
+type statusError struct {
+	statusCode int
+	body       []byte
 }
 
-func (r *rancherExporter) Collect(ch chan<- prometheus.Metric) {
-	r.asyncMetrics(ch)
+func (e *statusError) Error() string {
+	snippet := secretFieldPattern.ReplaceAll(e.body, []byte(`$1"<redacted>"`))
+	if len(snippet) > 256 {
+		snippet = append(snippet[:256:256], "..."...)
+	}
 
-	r.syncMetrics(ch)
+	return fmt.Sprintf("unexpected status %d %s, %s", e.statusCode, http.StatusText(e.statusCode), snippet)
 }
 
-func (r *rancherExporter) Stop() {
-	if r.websocketConn != nil {
-		r.websocketConn.Close()
+// rancherError tells whether a request failed with an error object of Rancher API, e.g. for an unsupported filter.
+func rancherError(err error) bool {
+	statusErr, ok := err.(*statusError)
+	if !ok {
+		return false
 	}
 
-	close(r.instancesBuff)
-	close(r.servicesBuff)
-	close(r.stacksBuff)
+	respType, _ := jsonparser.GetString(statusErr.body, "type")
+	return respType == "error"
 }
 
-func (r *rancherExporter) asyncMetrics(ch chan<- prometheus.Metric) {
-	// collect
-	extendingTotalStackBootstraps.Collect(ch)
-	extendingTotalSuccessStackBootstrap.Collect(ch)
-	extendingTotalErrorStackBootstrap.Collect(ch)
-	extendingTotalStackInitializations.Collect(ch)
-	extendingTotalSuccessStackInitialization.Collect(ch)
-	extendingTotalErrorStackInitialization.Collect(ch)
+// responseStatus reads the status a request failed with, 0 when it failed before any response.
+func responseStatus(err error) int {
+	if statusErr, ok := err.(*statusError); ok {
+		return statusErr.statusCode
+	}
 
-	extendingTotalServiceBootstraps.Collect(ch)
-	extendingTotalSuccessServiceBootstrap.Collect(ch)
-	extendingTotalErrorServiceBootstrap.Collect(ch)
-	extendingTotalServiceInitializations.Collect(ch)
-	extendingTotalSuccessServiceInitialization.Collect(ch)
-	extendingTotalErrorServiceInitialization.Collect(ch)
+	return 0
+}
 
-	extendingTotalInstanceBootstraps.Collect(ch)
-	extendingTotalSuccessInstanceBootstrap.Collect(ch)
-	extendingTotalErrorInstanceBootstrap.Collect(ch)
-	extendingTotalInstanceInitializations.Collect(ch)
-	extendingTotalSuccessInstanceInitialization.Collect(ch)
-	extendingTotalErrorInstanceInitialization.Collect(ch)
+// authorization builds the Authorization header of the requests to Rancher API for an environment, its own keys win
+// over a token, which wins over the keys.
+func authorization(projectId string) string {
+	if credentials, ok := environmentCredentials[projectId]; ok {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	if len(cattleToken) != 0 {
+		return "Bearer " + cattleToken
+	}
 
-	extendingInstanceBootstrapMsCost.Collect(ch)
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(cattleAccessKey+":"+cattleSecretKey))
 }
 
-func (r *rancherExporter) syncMetrics(ch chan<- prometheus.Metric) {
-	projectId := r.projectId
-	projectName := r.projectName
+// retryable tells whether a failed attempt is worth retrying, the other errors would fail the same way again,
+// e.g. an unknown host or a bad certificate.
+func retryable(statusCode int, err error) bool {
+	if statusCode == http.StatusTooManyRequests || statusCode >= 500 {
+		return true
+	}
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Errorln(err)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	return connectionFailed(err)
+}
+
+// connectionFailed tells whether an error comes from a refused or reset connection.
+func connectionFailed(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET
+		default:
+			return false
+		}
+	}
+}
+
+// logResponseBody logs the redacted response body at debug level, cut to the maximum log body bytes.
+func logResponseBody(url string, bs []byte) {
+	body := secretFieldPattern.ReplaceAll(bs, []byte(`$1"<redacted>"`))
+	if maxLogBodyBytes > 0 && len(body) > maxLogBodyBytes {
+		log.Debugf("%s answers %d bytes: %s...", url, len(bs), body[:maxLogBodyBytes])
+	} else {
+		log.Debugf("%s answers %d bytes: %s", url, len(bs), body)
+	}
+}
+
+// observeClockSkew compares the Date header with the local time, the header only comes in seconds.
+func observeClockSkew(header http.Header) {
+	now := time.Now()
+
+	clockSkewMutex.Lock()
+	defer clockSkewMutex.Unlock()
+
+	if now.Sub(clockSkewUpdated) < time.Minute {
+		return
+	}
+
+	if serverTime, err := http.ParseTime(header.Get("Date")); err == nil {
+		exporterClockSkew.Set(now.Sub(serverTime).Seconds())
+		clockSkewUpdated = now
+	}
+}
+
+// withContext copies the client to abort its requests once the context is done.
+func (r *httpClient) withContext(ctx context.Context) rancherAPI {
+	return &httpClient{
+		client:    r.client,
+		ctx:       ctx,
+		projectId: r.projectId,
+	}
+}
+
+// withEnvironment copies the client to authorize its requests with the credentials of the environment.
+func (r *httpClient) withEnvironment(projectId string) rancherAPI {
+	return &httpClient{
+		client:    r.client,
+		ctx:       r.ctx,
+		projectId: projectId,
+	}
+}
+
+func newHttpClient(timeoutSeconds time.Duration) *httpClient {
+	return &httpClient{
+		client: &http.Client{Timeout: timeoutSeconds, Transport: rancherTransport},
+		ctx:    context.Background(),
+	}
+}
+
+// newRancherTransport mirrors http.DefaultTransport with the given TLS config, shared by all the clients to keep the connections alive.
+func newRancherTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
+type scrapeErrors struct {
+	environmentName string
+	mutex           *sync.Mutex
+	counts          map[string]int
+}
+
+func (s *scrapeErrors) add(endpoint, address string, err error) {
+	log.Debugln(address, err)
+	exporterScrapeErrors.WithLabelValues(s.environmentName, endpoint).Inc()
+
+	kind := "error"
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			kind = "timeout"
+		} else {
+			kind = "network"
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.counts[endpoint+"/"+kind]++
+}
+
+func (s *scrapeErrors) empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.counts) == 0
+}
+
+func (s *scrapeErrors) summary() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.counts) == 0 {
+		return
+	}
+
+	total := 0
+	keys := make([]string, 0, len(s.counts))
+	for key, count := range s.counts {
+		total += count
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	details := make([]string, 0, len(keys))
+	for _, key := range keys {
+		details = append(details, fmt.Sprintf("%s=%d", key, s.counts[key]))
+	}
+
+	log.Warnln("scrape finished with", total, "errors:", strings.Join(details, ", "))
+}
+
+func newScrapeErrors(environmentName string) *scrapeErrors {
+	return &scrapeErrors{
+		environmentName: environmentName,
+		mutex:           &sync.Mutex{},
+		counts:          make(map[string]int),
+	}
+}
+
+// isCollection tells whether the response of an endpoint is a Rancher collection, counting the ones which are not.
+func isCollection(endpoint, address string, respBytes []byte) bool {
+	if _, dataType, _, err := jsonparser.Get(respBytes, "data"); err != nil || dataType != jsonparser.Array {
+		exporterDecodeErrors.WithLabelValues(endpoint).Inc()
+		log.Debugln(address, "does not answer a collection")
+		return false
+	}
+
+	return true
+}
+
+type objectCounter struct {
+	total  int64
+	system int64
+}
+
+func (c *objectCounter) add(system string) {
+	atomic.AddInt64(&c.total, 1)
+	if system == "true" {
+		atomic.AddInt64(&c.system, 1)
+	}
+}
+
+// objectSet records the stacks, services and instances seen by a scrape by their paths of names,
+// e.g. web, web/nginx and web/nginx/web-nginx-1.
+type objectSet struct {
+	mutex *sync.Mutex
+	paths map[string]struct{}
+}
+
+func (o *objectSet) add(names ...string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.paths[strings.Join(names, "\x00")] = struct{}{}
+}
+
+func (o *objectSet) has(names ...string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	_, ok := o.paths[strings.Join(names, "\x00")]
+	return ok
+}
+
+func newObjectSet() *objectSet {
+	return &objectSet{
+		mutex: &sync.Mutex{},
+		paths: make(map[string]struct{}, 64),
+	}
+}
+
+type loadBalancer struct {
+	stackName string
+	name      string
+	system    string
+	targetIds []string
+}
+
+// backendTracker correlates the load balancers with the instances of their target services within one scrape,
+// the services are fetched concurrently, so the balancers are only resolved once all of them are done.
+type backendTracker struct {
+	mutex     *sync.Mutex
+	healthy   map[string]int64
+	total     map[string]int64
+	balancers []loadBalancer
+}
+
+func (t *backendTracker) addBalancer(stackName, name, system string, serviceBytes []byte) {
+	targetIds := make([]string, 0, 4)
+	seen := make(map[string]struct{}, 4)
+	jsonparser.ArrayEach(serviceBytes, func(portRuleBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+		targetId, _ := jsonparser.GetString(portRuleBytes, "serviceId")
+		if _, ok := seen[targetId]; len(targetId) == 0 || ok {
+			return
+		}
+		seen[targetId] = struct{}{}
+		targetIds = append(targetIds, targetId)
+	}, "lbConfig", "portRules")
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.balancers = append(t.balancers, loadBalancer{stackName, name, system, targetIds})
+}
+
+func (t *backendTracker) addBackends(serviceId string, healthy, total int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.healthy[serviceId] += healthy
+	t.total[serviceId] += total
+}
+
+func (t *backendTracker) set(projectName string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, balancer := range t.balancers {
+		healthy, total := int64(0), int64(0)
+		for _, targetId := range balancer.targetIds {
+			healthy += t.healthy[targetId]
+			total += t.total[targetId]
+		}
+
+		extendingLBHealthyBackends.WithLabelValues(projectName, balancer.stackName, balancer.name, balancer.system).Set(float64(healthy))
+		extendingLBTotalBackends.WithLabelValues(projectName, balancer.stackName, balancer.name, balancer.system).Set(float64(total))
+	}
+}
+
+// syncScrape holds the state shared by the fetches of one scrape.
+type syncScrape struct {
+	api       rancherAPI
+	ctx       context.Context
+	project   *rancherProject
+	errs      *scrapeErrors
+	seen      *objectSet
+	stacks    *objectCounter
+	services  *objectCounter
+	instances *objectCounter
+	backends  *backendTracker
+
+	// false for the filtered fetches only asking for the stacks, which skip the services and instances listings
+	withServices bool
+}
+
+// eachData calls back with every item of a Rancher collection, following the pagination.
+func (s *syncScrape) eachData(endpoint, address string, cb func(dataBytes []byte)) {
+	pageDuration := exporterFirstPageDuration
+	pages := newPager()
+	for {
+		// stop paging once the scrape timed out, the pages so far are kept
+		select {
+		case <-s.ctx.Done():
+			s.errs.add(endpoint, address, s.ctx.Err())
+			return
+		default:
+		}
+
+		pageStart := time.Now()
+		respBytes, err := s.api.get(address)
+		pageDuration.Observe(time.Since(pageStart).Seconds())
+
+		if rancherError(err) && strings.Contains(address, removedInstancesFilter) {
+			log.Debugln(address, "does not support filtering the removed instances")
+			address = strings.Replace(address, removedInstancesFilter, "", -1)
+		} else if err != nil {
+			s.errs.add(endpoint, address, err)
+			break
+		} else if !isCollection(endpoint, address, respBytes) {
+			break
+		} else {
+			jsonparser.ArrayEach(respBytes, func(dataBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+				cb(dataBytes)
+			}, "data")
+
+			if next, err := pages.next(address, respBytes); err != nil {
+				s.errs.add(endpoint, address, err)
+				break
+			} else if len(next) == 0 {
+				break
+			} else {
+				address = next
+				pageDuration = exporterSubsequentPageDuration
+			}
+		}
+	}
+}
+
+// pager follows the next links of a Rancher listing, stopping at a link seen before or past the maximum pages,
+// e.g. behind a proxy rewriting the links back to the first page.
+type pager struct {
+	seen map[string]bool
+}
+
+func (p *pager) next(address string, respBytes []byte) (string, error) {
+	next, _ := jsonparser.GetString(respBytes, "pagination", "next")
+	if len(next) == 0 {
+		return "", nil
+	}
+
+	p.seen[address] = true
+	if p.seen[next] {
+		return "", errors.New("the next page links back to " + next + ", stopping the paging")
+	}
+	if maxPages > 0 && len(p.seen) >= maxPages {
+		return "", errors.New(fmt.Sprintf("the listing passes %d pages, stopping the paging", maxPages))
+	}
+
+	return next, nil
+}
+
+func newPager() *pager {
+	return &pager{seen: make(map[string]bool)}
+}
+
+func newSyncScrape(api rancherAPI, ctx context.Context, project *rancherProject) *syncScrape {
+	return &syncScrape{
+		api:       api,
+		ctx:       ctx,
+		project:   project,
+		errs:      newScrapeErrors(project.name),
+		seen:      newObjectSet(),
+		stacks:    &objectCounter{},
+		services:  &objectCounter{},
+		instances: &objectCounter{},
+		backends: &backendTracker{
+			mutex:   &sync.Mutex{},
+			healthy: make(map[string]int64),
+			total:   make(map[string]int64),
+		},
+		withServices: true,
+	}
+}
+
+// listedService is a service listed within its stack, waiting for its instances to be fetched.
+type listedService struct {
+	stackId      string
+	stackName    string
+	serviceBytes []byte
+}
+
+// spawn runs fn in a goroutine of the wait group once a fetch slot is free,
+// the caller must not hold a slot itself, or the workers could end up waiting on each other.
+func spawn(wg *sync.WaitGroup, fn func()) {
+	limiter := fetchLimiter
+	if limiter != nil {
+		limiter <- struct{}{}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if limiter != nil {
+			defer func() {
+				<-limiter
+			}()
+		}
+
+		fn()
+	}()
+}
+
+type startupSample struct {
+	instanceId string
+	ms         float64
+}
+
+type startupAverage struct {
+	value      float64
+	instances  map[string]struct{}
+	generation int64
+}
+
+// startupAverages keeps the startup averages of the services across the scrapes, a recreated service comes with a new id and starts over.
+type startupAverages struct {
+	mutex      *sync.Mutex
+	services   map[string]*startupAverage
+	generation int64
+}
+
+func (a *startupAverages) begin() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.generation++
+}
+
+// update folds the instances not seen before into the average of the service.
+func (a *startupAverages) update(serviceId string, samples []startupSample) (float64, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	average, ok := a.services[serviceId]
+	if !ok {
+		if len(samples) == 0 {
+			return 0, false
+		}
+
+		average = &startupAverage{
+			value:     samples[0].ms,
+			instances: make(map[string]struct{}, len(samples)),
+		}
+		a.services[serviceId] = average
+	}
+
+	instances := make(map[string]struct{}, len(samples))
+	for _, sample := range samples {
+		instances[sample.instanceId] = struct{}{}
+		if _, ok := average.instances[sample.instanceId]; !ok {
+			average.value = startupEMAAlpha*sample.ms + (1-startupEMAAlpha)*average.value
+		}
+	}
+	average.instances = instances
+	average.generation = a.generation
+
+	return average.value, true
+}
+
+// prune drops the services not updated since the last begin.
+func (a *startupAverages) prune() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for serviceId, average := range a.services {
+		if average.generation != a.generation {
+			delete(a.services, serviceId)
+		}
+	}
+}
+
+func newStartupAverages() *startupAverages {
+	return &startupAverages{
+		mutex:    &sync.Mutex{},
+		services: make(map[string]*startupAverage, 32),
+	}
+}
+
+type stateSince struct {
+	state      string
+	since      time.Time
+	generation int64
+}
+
+// stateTracker remembers since when the objects have been in their current states across the scrapes.
+type stateTracker struct {
+	mutex      *sync.Mutex
+	objects    map[string]*stateSince
+	generation int64
+}
+
+func (t *stateTracker) begin() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.generation++
+}
+
+// observe tells since when the object has been in the state, the first sight counts as the start.
+func (t *stateTracker) observe(id, state string) time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	object, ok := t.objects[id]
+	if !ok || object.state != state {
+		object = &stateSince{
+			state: state,
+			since: time.Now(),
+		}
+		t.objects[id] = object
+	}
+	object.generation = t.generation
+
+	return object.since
+}
+
+// prune drops the objects not observed since the last begin.
+func (t *stateTracker) prune() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for id, object := range t.objects {
+		if object.generation != t.generation {
+			delete(t.objects, id)
+		}
+	}
+}
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{
+		mutex:   &sync.Mutex{},
+		objects: make(map[string]*stateSince, 32),
+	}
+}
+
+// seriesTracker remembers the label values set on the vectors which are not reset on every scrape,
+// so the series of the objects gone from Rancher can be deleted.
+type seriesTracker struct {
+	mutex      *sync.Mutex
+	series     map[string]*trackedSeries
+	generation int64
+}
+
+type trackedSeries struct {
+	labelValues []string
+	generation  int64
+}
+
+func (t *seriesTracker) begin() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.generation++
+}
+
+func (t *seriesTracker) observe(labelValues []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	if series, ok := t.series[key]; ok {
+		series.generation = t.generation
+	} else {
+		t.series[key] = &trackedSeries{
+			labelValues: append([]string(nil), labelValues...),
+			generation:  t.generation,
+		}
+	}
+}
+
+// prune deletes the series not observed since the last begin from the vectors, keeping the ones keep tells to.
+func (t *seriesTracker) prune(keep func(labelValues []string) bool, vectors ...*prometheus.GaugeVec) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, series := range t.series {
+		if series.generation == t.generation || keep(series.labelValues) {
+			continue
+		}
+
+		for _, vector := range vectors {
+			vector.DeleteLabelValues(series.labelValues...)
+		}
+		delete(t.series, key)
+	}
+}
+
+func newSeriesTracker() *seriesTracker {
+	return &seriesTracker{
+		mutex:  &sync.Mutex{},
+		series: make(map[string]*trackedSeries, 64),
+	}
+}
+
+type buffMsg struct {
+	id            string
+	name          string
+	state         string
+	healthState   string
+	transitioning string
+	serviceName   string
+	stackName     string
+}
+
+// rancherProject is one of the environments collected by the exporter, with the events of its extended metrics.
+type rancherProject struct {
+	id     string
+	name   string
+	events eventSource
+
+	stacksBuff    chan buffMsg
+	servicesBuff  chan buffMsg
+	instancesBuff chan buffMsg
+}
+
+func newRancherProject(id, name string, events eventSource) *rancherProject {
+	return &rancherProject{
+		id:     id,
+		name:   name,
+		events: events,
+
+		stacksBuff:    make(chan buffMsg, 16),
+		servicesBuff:  make(chan buffMsg, 16),
+		instancesBuff: make(chan buffMsg, 16),
+	}
+}
+
+/**
+	RancherExporter
+ */
+type rancherExporter struct {
+	// accessed atomically, first to be 64-bit aligned on 32-bit platforms
+	fetchStartNanos int64
+	everSynced      int32
+
+	projects []*rancherProject
+	mutex    *sync.Mutex
+	api      rancherAPI
+
+	probeLimiter    chan struct{}
+	syncedTime      time.Time
+	syncInterval    time.Duration
+	startupAverages *startupAverages
+	stackStates     *stateTracker
+	bootstrapSeries *seriesTracker
+	seriesDescs     map[*prometheus.Desc]string
+	objectDescs     map[*prometheus.Desc]struct{}
+	seriesMutex     *sync.Mutex
+	emittedSeries   map[string]struct{}
+	stopped         chan struct{}
+	fetched         chan struct{}
+
+	infinityWorksMetrics []prometheus.Metric
+	infinityWorksStale   bool
+}
+
+func (r *rancherExporter) Describe(ch chan<- *prometheus.Desc) {
+	infinityWorksStacksHealth.Describe(ch)
+	infinityWorksStacksState.Describe(ch)
+	infinityWorksServicesScale.Describe(ch)
+	infinityWorksServicesHealth.Describe(ch)
+	infinityWorksServicesState.Describe(ch)
+	infinityWorksHostsState.Describe(ch)
+	infinityWorksHostAgentsState.Describe(ch)
+	extendingHostCPUCores.Describe(ch)
+	extendingHostMemoryBytes.Describe(ch)
+	extendingHostLabels.Describe(ch)
+
+	extendingTotalStackInitializations.Describe(ch)
+	extendingTotalSuccessStackInitialization.Describe(ch)
+	extendingTotalErrorStackInitialization.Describe(ch)
+	extendingTotalServiceInitializations.Describe(ch)
+	extendingTotalSuccessServiceInitialization.Describe(ch)
+	extendingTotalErrorServiceInitialization.Describe(ch)
+	extendingTotalInstanceInitializations.Describe(ch)
+	extendingTotalSuccessInstanceInitialization.Describe(ch)
+	extendingTotalErrorInstanceInitialization.Describe(ch)
+
+	extendingTotalStackBootstraps.Describe(ch)
+	extendingTotalSuccessStackBootstrap.Describe(ch)
+	extendingTotalErrorStackBootstrap.Describe(ch)
+	extendingTotalServiceBootstraps.Describe(ch)
+	extendingTotalSuccessServiceBootstrap.Describe(ch)
+	extendingTotalErrorServiceBootstrap.Describe(ch)
+	extendingTotalInstanceBootstraps.Describe(ch)
+	extendingTotalSuccessInstanceBootstrap.Describe(ch)
+	extendingTotalErrorInstanceBootstrap.Describe(ch)
+	extendingInstanceBootstrapMsCost.Describe(ch)
+	extendingInstanceBootstrapSeconds.Describe(ch)
+
+	extendingTotalStackRemovals.Describe(ch)
+	extendingTotalServiceRemovals.Describe(ch)
+
+	extendingInstanceHeartbeat.Describe(ch)
+	extendingServiceHeartbeat.Describe(ch)
+	extendingStackHeartbeat.Describe(ch)
+	extendingStackStuck.Describe(ch)
+	extendingServiceEndpointReachable.Describe(ch)
+	extendingServiceStatus.Describe(ch)
+	extendingServiceDown.Describe(ch)
+	extendingServiceInstancesRunning.Describe(ch)
+	extendingServiceRegistering.Describe(ch)
+	extendingServiceStartupMsEMA.Describe(ch)
+	extendingServiceStartupSecondsEMA.Describe(ch)
+	extendingProjectsTotal.Describe(ch)
+	extendingStacksTotal.Describe(ch)
+	extendingServicesTotal.Describe(ch)
+	extendingInstancesTotal.Describe(ch)
+	extendingSystemObjectCount.Describe(ch)
+	extendingSystemObjectRatio.Describe(ch)
+	extendingEnvironmentMemberCount.Describe(ch)
+	extendingInstanceDataAge.Describe(ch)
+	extendingInstanceNeverRunning.Describe(ch)
+	extendingInstanceRestartCount.Describe(ch)
+	extendingServiceOwnerInfo.Describe(ch)
+	extendingServiceSelfLink.Describe(ch)
+	extendingLBHealthyBackends.Describe(ch)
+	extendingLBTotalBackends.Describe(ch)
+
+	exporterPushErrors.Describe(ch)
+	exporterServiceFetchDuration.Describe(ch)
+	exporterEnvironmentFetchDuration.Describe(ch)
+	exporterScrapeDuration.Describe(ch)
+	exporterScrapeSuccess.Describe(ch)
+	exporterRateLimitWait.Describe(ch)
+	exporterRateLimit.Describe(ch)
+	exporterRateLimitBurst.Describe(ch)
+	exporterAPIRequestDuration.Describe(ch)
+	exporterAPIRequests.Describe(ch)
+	exporterDecodeErrors.Describe(ch)
+	exporterScrapeErrors.Describe(ch)
+	exporterFirstPageDuration.Describe(ch)
+	exporterSubsequentPageDuration.Describe(ch)
+	exporterAPIBytesRead.Describe(ch)
+	exporterTruncatedLabels.Describe(ch)
+	exporterAPICompatible.Describe(ch)
+	exporterClockSkew.Describe(ch)
+	exporterScrapeInFlight.Describe(ch)
+	exporterRancherUp.Describe(ch)
+	exporterScrapeInterval.Describe(ch)
+	exporterSeriesCount.Describe(ch)
+	exporterSeriesCapped.Describe(ch)
+	exporterStartTime.Describe(ch)
+	exporterHideSystem.Describe(ch)
+	exporterScrapeCacheHits.Describe(ch)
+	exporterScrapeCacheMisses.Describe(ch)
+}
+
+func (r *rancherExporter) Collect(ch chan<- prometheus.Metric) {
+	r.collect(ch, nil, true)
+}
+
+// collect sends the metrics of a fetch of the collector groups, nil meaning all of them, or of the last fetch when
+// not fetching. Only the complete fetches account for the series, the others leave the series counts and the series
+// known to the cap as they are.
+func (r *rancherExporter) collect(ch chan<- prometheus.Metric, groups map[string]bool, fetch bool) {
+	complete := groups == nil && fetch
+
+	metrics := make(chan prometheus.Metric, 64)
+	go func() {
+		defer close(metrics)
+
+		r.asyncMetrics(metrics)
+
+		if fetch {
+			r.syncMetrics(metrics, groups)
+		} else {
+			r.mutex.Lock()
+			r.collectSyncMetrics(metrics)
+			r.mutex.Unlock()
+		}
+	}()
+
+	// count the series on the way out
+	seriesCounts := make(map[*prometheus.Desc]int, len(r.seriesDescs))
+	var objectMetrics []prometheus.Metric
+	for metric := range metrics {
+		if _, ok := r.seriesDescs[metric.Desc()]; ok && complete {
+			seriesCounts[metric.Desc()]++
+		}
+
+		// hold the object metrics back to be capped
+		if _, ok := r.objectDescs[metric.Desc()]; ok && maxTotalSeries > 0 {
+			objectMetrics = append(objectMetrics, metric)
+			continue
+		}
+		ch <- metric
+	}
+
+	if maxTotalSeries > 0 {
+		r.capSeries(ch, objectMetrics, complete)
+	}
+
+	if complete {
+		for desc, name := range r.seriesDescs {
+			exporterSeriesCount.WithLabelValues(name).Set(float64(seriesCounts[desc]))
+		}
+	}
+	exporterSeriesCount.Collect(ch)
+	exporterSeriesCapped.Collect(ch)
+}
+
+// capSeries lets at most the maximum total series through, preferring the ones let through on the last collect,
+// which are only replaced when remembering.
+func (r *rancherExporter) capSeries(ch chan<- prometheus.Metric, metrics []prometheus.Metric, remember bool) {
+	r.seriesMutex.Lock()
+	defer r.seriesMutex.Unlock()
+
+	keys := make([]string, len(metrics))
+	for i, metric := range metrics {
+		keys[i] = seriesKey(metric)
+	}
+
+	emitted := make(map[string]struct{}, maxTotalSeries)
+	for pass := 0; pass < 2; pass++ {
+		for i, metric := range metrics {
+			if len(emitted) >= maxTotalSeries {
+				break
+			}
+
+			// the first pass only takes the known series
+			if _, known := r.emittedSeries[keys[i]]; known != (pass == 0) {
+				continue
+			}
+			if _, ok := emitted[keys[i]]; ok {
+				continue
+			}
+
+			emitted[keys[i]] = struct{}{}
+			ch <- metric
+		}
+	}
+	if !remember {
+		return
+	}
+	r.emittedSeries = emitted
+
+	if dropped := len(metrics) - len(emitted); dropped > 0 {
+		exporterSeriesCapped.Set(1)
+		log.Warnln("the environments exceed", maxTotalSeries, "series, dropped", dropped, "new series")
+	} else {
+		exporterSeriesCapped.Set(0)
+	}
+}
+
+func seriesKey(metric prometheus.Metric) string {
+	pb := &dto.Metric{}
+	metric.Write(pb)
+
+	key := fmt.Sprintf("%p", metric.Desc())
+	for _, labelPair := range pb.GetLabel() {
+		key += "," + labelPair.GetName() + "=" + labelPair.GetValue()
+	}
+
+	return key
+}
+
+func (r *rancherExporter) Stop() {
+	for _, project := range r.projects {
+		project.events.close()
+	}
+
+	close(r.stopped)
+
+	for _, project := range r.projects {
+		close(project.instancesBuff)
+		close(project.servicesBuff)
+		close(project.stacksBuff)
+	}
+}
+
+// seriesCountedVectors lists the vectors whose series grow with the objects in Rancher.
+func seriesCountedVectors() map[string]prometheus.Collector {
+	return map[string]prometheus.Collector{
+		namespace + "_host_state":                     infinityWorksHostsState,
+		namespace + "_host_agent_state":               infinityWorksHostAgentsState,
+		namespace + "_host_cpu_cores":                 extendingHostCPUCores,
+		namespace + "_host_memory_bytes":              extendingHostMemoryBytes,
+		namespace + "_host_labels":                    extendingHostLabels,
+		namespace + "_stack_health_status":            infinityWorksStacksHealth,
+		namespace + "_stack_state":                    infinityWorksStacksState,
+		namespace + "_service_scale":                  infinityWorksServicesScale,
+		namespace + "_service_health_status":          infinityWorksServicesHealth,
+		namespace + "_service_state":                  infinityWorksServicesState,
+		namespace + "_stack_heartbeat":                extendingStackHeartbeat,
+		namespace + "_service_heartbeat":              extendingServiceHeartbeat,
+		namespace + "_instance_heartbeat":             extendingInstanceHeartbeat,
+		namespace + "_instance_bootstrap_ms":          extendingInstanceBootstrapMsCost,
+		namespace + "_instance_bootstrap_seconds":     extendingInstanceBootstrapSeconds,
+		namespace + "_instance_data_age_seconds":      extendingInstanceDataAge,
+		namespace + "_instance_never_running":         extendingInstanceNeverRunning,
+		namespace + "_instance_restart_count":         extendingInstanceRestartCount,
+		namespace + "_instances_bootstrap_total":      extendingTotalInstanceBootstraps,
+		namespace + "_instances_initialization_total": extendingTotalInstanceInitializations,
+		namespace + "_service_status":                 extendingServiceStatus,
+		namespace + "_service_down":                   extendingServiceDown,
+		namespace + "_service_instances_running":      extendingServiceInstancesRunning,
+		namespace + "_service_startup_ms_ema":         extendingServiceStartupMsEMA,
+		namespace + "_service_startup_seconds_ema":    extendingServiceStartupSecondsEMA,
+		namespace + "_service_self_link":              extendingServiceSelfLink,
+		namespace + "_lb_healthy_backends":            extendingLBHealthyBackends,
+		namespace + "_lb_total_backends":              extendingLBTotalBackends,
+		namespace + "_service_owner_info":             extendingServiceOwnerInfo,
+		namespace + "_service_endpoint_reachable":     extendingServiceEndpointReachable,
+		namespace + "_services_bootstrap_total":       extendingTotalServiceBootstraps,
+		namespace + "_services_initialization_total":  extendingTotalServiceInitializations,
+		namespace + "_stacks_bootstrap_total":         extendingTotalStackBootstraps,
+		namespace + "_stacks_initialization_total":    extendingTotalStackInitializations,
+	}
+}
+
+func newSeriesDescs() map[*prometheus.Desc]string {
+	seriesDescs := make(map[*prometheus.Desc]string, 32)
+	for name, vector := range seriesCountedVectors() {
+		descs := make(chan *prometheus.Desc, 1)
+		vector.Describe(descs)
+		seriesDescs[<-descs] = name
+	}
+
+	return seriesDescs
+}
+
+// newObjectDescs lists the descriptions of all the metrics in the collector groups.
+func newObjectDescs() map[*prometheus.Desc]struct{} {
+	objectDescs := make(map[*prometheus.Desc]struct{}, 64)
+	for _, collectors := range collectorGroups() {
+		for _, collector := range collectors {
+			descs := make(chan *prometheus.Desc, 1)
+			collector.Describe(descs)
+			objectDescs[<-descs] = struct{}{}
+		}
+	}
+
+	return objectDescs
+}
+
+// fetch fetches from Rancher without sending the metrics anywhere, e.g. to push when nothing scrapes.
+func (r *rancherExporter) fetch() {
+	metrics := make(chan prometheus.Metric, 64)
+	go func() {
+		defer close(metrics)
+
+		r.collect(metrics, nil, true)
+	}()
+
+	for range metrics {
+	}
+}
+
+// ready tells whether a fetch from Rancher has ever succeeded without any error.
+func (r *rancherExporter) ready() bool {
+	return atomic.LoadInt32(&r.everSynced) == 1
+}
+
+// watchInFlight keeps the seconds of the running fetch up to date, so a wedged fetch shows while it is still running.
+func (r *rancherExporter) watchInFlight() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopped:
+			return
+		case <-ticker.C:
+			if fetchStartNanos := atomic.LoadInt64(&r.fetchStartNanos); fetchStartNanos == 0 {
+				exporterScrapeInFlight.Set(0)
+			} else {
+				exporterScrapeInFlight.Set(time.Since(time.Unix(0, fetchStartNanos)).Seconds())
+			}
+		}
+	}
+}
+
+// collectorGroups lists the metrics which can be picked by the collect[] query parameter, the exporter metrics are always collected.
+func collectorGroups() map[string][]prometheus.Collector {
+	return map[string][]prometheus.Collector{
+		"hosts": {
+			infinityWorksHostsState,
+			infinityWorksHostAgentsState,
+			extendingHostCPUCores,
+			extendingHostMemoryBytes,
+			extendingHostLabels,
+		},
+		"stacks": {
+			infinityWorksStacksHealth,
+			infinityWorksStacksState,
+		},
+		"services": {
+			infinityWorksServicesScale,
+			extendingServiceInstancesRunning,
+			infinityWorksServicesHealth,
+			infinityWorksServicesState,
+		},
+		"instances": {
+			extendingInstanceHeartbeat,
+			extendingInstanceBootstrapMsCost,
+			extendingInstanceBootstrapSeconds,
+			extendingInstanceDataAge,
+			extendingInstanceNeverRunning,
+			extendingInstanceRestartCount,
+		},
+		"extended": {
+			extendingTotalStackInitializations,
+			extendingTotalSuccessStackInitialization,
+			extendingTotalErrorStackInitialization,
+			extendingTotalServiceInitializations,
+			extendingTotalSuccessServiceInitialization,
+			extendingTotalErrorServiceInitialization,
+			extendingTotalInstanceInitializations,
+			extendingTotalSuccessInstanceInitialization,
+			extendingTotalErrorInstanceInitialization,
+			extendingTotalStackBootstraps,
+			extendingTotalSuccessStackBootstrap,
+			extendingTotalErrorStackBootstrap,
+			extendingTotalServiceBootstraps,
+			extendingTotalSuccessServiceBootstrap,
+			extendingTotalErrorServiceBootstrap,
+			extendingTotalInstanceBootstraps,
+			extendingTotalSuccessInstanceBootstrap,
+			extendingTotalErrorInstanceBootstrap,
+			extendingTotalStackRemovals,
+			extendingTotalServiceRemovals,
+			extendingProjectsTotal,
+			extendingStacksTotal,
+			extendingServicesTotal,
+			extendingInstancesTotal,
+			extendingSystemObjectCount,
+			extendingSystemObjectRatio,
+			extendingEnvironmentMemberCount,
+			extendingServiceStatus,
+			extendingServiceDown,
+			extendingServiceRegistering,
+			extendingServiceStartupMsEMA,
+			extendingServiceStartupSecondsEMA,
+			extendingServiceOwnerInfo,
+			extendingServiceSelfLink,
+			extendingLBHealthyBackends,
+			extendingLBTotalBackends,
+			extendingServiceEndpointReachable,
+			extendingStackHeartbeat,
+			extendingStackStuck,
+			extendingServiceHeartbeat,
+		},
+	}
+}
+
+/**
+	FilteredExporter
+ */
+type filteredExporter struct {
+	exporter *rancherExporter
+	groups   map[string]bool
+	excluded map[*prometheus.Desc]struct{}
+}
+
+func (f *filteredExporter) Describe(ch chan<- *prometheus.Desc) {
+	descs := make(chan *prometheus.Desc, 16)
+	go func() {
+		defer close(descs)
+
+		f.exporter.Describe(descs)
+	}()
+
+	for desc := range descs {
+		if _, ok := f.excluded[desc]; !ok {
+			ch <- desc
+		}
+	}
+}
+
+func (f *filteredExporter) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric, 64)
+	go func() {
+		defer close(metrics)
+
+		f.exporter.collect(metrics, f.groups, true)
+	}()
+
+	for metric := range metrics {
+		if _, ok := f.excluded[metric.Desc()]; !ok {
+			ch <- metric
+		}
+	}
+}
+
+// newFilteredExporter only fetches and lets through the metrics of the named groups and the exporter metrics.
+func newFilteredExporter(exporter *rancherExporter, names []string) (*filteredExporter, error) {
+	groups := collectorGroups()
+
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := groups[name]; !ok {
+			return nil, errors.New("unknown collector " + name)
+		}
+		delete(groups, name)
+		selected[name] = true
+	}
+
+	excluded := make(map[*prometheus.Desc]struct{}, 64)
+	descs := make(chan *prometheus.Desc, 16)
+	go func() {
+		defer close(descs)
+
+		for _, collectors := range groups {
+			for _, collector := range collectors {
+				collector.Describe(descs)
+			}
+		}
+	}()
+	for desc := range descs {
+		excluded[desc] = struct{}{}
+	}
+
+	return &filteredExporter{
+		exporter: exporter,
+		groups:   selected,
+		excluded: excluded,
+	}, nil
+}
+
+/**
+	LastFetchExporter
+ */
+type lastFetchExporter struct {
+	exporter *rancherExporter
+}
+
+func (l *lastFetchExporter) Describe(ch chan<- *prometheus.Desc) {
+	l.exporter.Describe(ch)
+}
+
+func (l *lastFetchExporter) Collect(ch chan<- prometheus.Metric) {
+	l.exporter.collect(ch, nil, false)
+}
+
+// newLastFetchExporter serves the metrics of the last fetch from Rancher without fetching again, e.g. for the pushes.
+func newLastFetchExporter(exporter *rancherExporter) *lastFetchExporter {
+	return &lastFetchExporter{
+		exporter: exporter,
+	}
+}
+
+func (r *rancherExporter) asyncMetrics(ch chan<- prometheus.Metric) {
+	// collect
+	extendingTotalStackBootstraps.Collect(ch)
+	extendingTotalSuccessStackBootstrap.Collect(ch)
+	extendingTotalErrorStackBootstrap.Collect(ch)
+	extendingTotalStackInitializations.Collect(ch)
+	extendingTotalSuccessStackInitialization.Collect(ch)
+	extendingTotalErrorStackInitialization.Collect(ch)
+
+	extendingTotalServiceBootstraps.Collect(ch)
+	extendingTotalSuccessServiceBootstrap.Collect(ch)
+	extendingTotalErrorServiceBootstrap.Collect(ch)
+	extendingTotalServiceInitializations.Collect(ch)
+	extendingTotalSuccessServiceInitialization.Collect(ch)
+	extendingTotalErrorServiceInitialization.Collect(ch)
+
+	extendingTotalInstanceBootstraps.Collect(ch)
+	extendingTotalSuccessInstanceBootstrap.Collect(ch)
+	extendingTotalErrorInstanceBootstrap.Collect(ch)
+	extendingTotalInstanceInitializations.Collect(ch)
+	extendingTotalSuccessInstanceInitialization.Collect(ch)
+	extendingTotalErrorInstanceInitialization.Collect(ch)
+
+	extendingInstanceBootstrapMsCost.Collect(ch)
+	extendingInstanceBootstrapSeconds.Collect(ch)
+
+	extendingTotalStackRemovals.Collect(ch)
+	extendingTotalServiceRemovals.Collect(ch)
+
+	exporterPushErrors.Collect(ch)
+	exporterAPICompatible.Collect(ch)
+	exporterClockSkew.Collect(ch)
+	exporterScrapeInFlight.Collect(ch)
+	exporterScrapeInterval.Collect(ch)
+	exporterStartTime.Collect(ch)
+	exporterHideSystem.Collect(ch)
+	exporterDecodeErrors.Collect(ch)
+	exporterScrapeErrors.Collect(ch)
+	exporterFirstPageDuration.Collect(ch)
+	exporterSubsequentPageDuration.Collect(ch)
+	exporterAPIBytesRead.Collect(ch)
+	exporterTruncatedLabels.Collect(ch)
+}
+
+// syncVecs lists the metrics renewed by every fetch.
+func syncVecs() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		infinityWorksHostsState,
+		infinityWorksHostAgentsState,
+		extendingHostCPUCores,
+		extendingHostMemoryBytes,
+		extendingHostLabels,
+		infinityWorksStacksHealth,
+		infinityWorksStacksState,
+		extendingStackHeartbeat,
+		extendingStackStuck,
+		infinityWorksServicesScale,
+		infinityWorksServicesHealth,
+		infinityWorksServicesState,
+		extendingServiceHeartbeat,
+		extendingInstanceHeartbeat,
+		extendingServiceEndpointReachable,
+		extendingServiceStatus,
+		extendingServiceDown,
+		extendingServiceInstancesRunning,
+		extendingServiceRegistering,
+		extendingServiceStartupMsEMA,
+		extendingServiceStartupSecondsEMA,
+		extendingStacksTotal,
+		extendingServicesTotal,
+		extendingInstancesTotal,
+		extendingSystemObjectCount,
+		extendingSystemObjectRatio,
+		extendingEnvironmentMemberCount,
+		extendingInstanceDataAge,
+		extendingInstanceNeverRunning,
+		extendingInstanceRestartCount,
+		extendingServiceOwnerInfo,
+		extendingServiceSelfLink,
+		extendingLBHealthyBackends,
+		extendingLBTotalBackends,
+	}
+}
+
+// selectedCollector tells whether the collector belongs to one of the groups.
+func selectedCollector(collector prometheus.Collector, groups map[string]bool) bool {
+	for name, collectors := range collectorGroups() {
+		if !groups[name] {
+			continue
+		}
+		for _, c := range collectors {
+			if c == collector {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// syncMetrics fetches the collector groups, nil meaning all of them. A filtered fetch skips the listings none of its
+// groups needs, and as an incomplete fetch, it is neither cached nor pruning anything.
+func (r *rancherExporter) syncMetrics(ch chan<- prometheus.Metric, groups map[string]bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorln(err)
+		}
+	}()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// serve the last fetch if it is fresh enough
+	if r.syncInterval > 0 && time.Since(r.syncedTime) < r.syncInterval {
+		exporterScrapeCacheHits.Inc()
+		r.collectSyncMetrics(ch)
+		return
+	}
+	exporterScrapeCacheMisses.Inc()
+
+	complete := groups == nil
+	wanted := func(names ...string) bool {
+		for _, name := range names {
+			if complete || groups[name] {
+				return true
+			}
+		}
+		return false
+	}
+
+	fetchStart := time.Now()
+	atomic.StoreInt64(&r.fetchStartNanos, fetchStart.UnixNano())
+	defer atomic.StoreInt64(&r.fetchStartNanos, 0)
+
+	// a filtered fetch only renews the metrics of its groups, the others keep the last fetch
+	for _, vec := range syncVecs() {
+		if complete || selectedCollector(vec, groups) {
+			vec.Reset()
+		}
+	}
+
+	api := r.api
+	ctx := context.Background()
+	if scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, scrapeTimeout)
+		defer cancel()
+
+		api = api.withContext(ctx)
+	}
+
+	// every environment has a scrape of its own, they share the limits and the timeout
+	scrapes := make([]*syncScrape, len(r.projects))
+	for i, project := range r.projects {
+		scrapes[i] = newSyncScrape(api.withEnvironment(project.id), ctx, project)
+		scrapes[i].withServices = wanted("services", "instances", "extended")
+	}
+
+	gwg := &sync.WaitGroup{}
+	if complete {
+		r.startupAverages.begin()
+		r.stackStates.begin()
+		r.bootstrapSeries.begin()
+	}
+
+	// the projects are listed once for all the environments, the errors count under the first one
+	gwg.Add(1)
+	go func() {
+		defer gwg.Done()
+
+		r.syncProjects(scrapes[0])
+	}()
+
+	for _, s := range scrapes {
+		s := s
+
+		if wanted("hosts") {
+			gwg.Add(1)
+			go func() {
+				defer gwg.Done()
+
+				r.syncHosts(s)
+			}()
+		}
+
+		if collectMembers && wanted("extended") {
+			gwg.Add(1)
+			go func() {
+				defer gwg.Done()
+
+				r.syncMembers(s)
+			}()
+		}
+
+		if wanted("stacks", "services", "instances", "extended") {
+			gwg.Add(1)
+			go func() {
+				defer gwg.Done()
+
+				environmentFetchStart := time.Now()
+				if fetchEngine == "flat" {
+					r.syncStacksFlat(s)
+				} else {
+					r.syncStacksNested(s)
+				}
+				if complete {
+					exporterEnvironmentFetchDuration.WithLabelValues(s.project.name).Observe(time.Since(environmentFetchStart).Seconds())
+				}
+			}()
+		}
+	}
+
+	gwg.Wait()
+	if complete {
+		r.syncedTime = time.Now()
+		exporterScrapeDuration.Observe(r.syncedTime.Sub(fetchStart).Seconds())
+
+		if adaptiveInterval {
+			r.syncInterval = adaptInterval(r.syncInterval, r.syncedTime.Sub(fetchStart))
+			exporterScrapeInterval.Set(r.syncInterval.Seconds())
+		}
+	}
+
+	if wanted("extended") {
+		extendingProjectsTotal.Set(float64(len(scrapes)))
+	}
+
+	synced := true
+	for _, s := range scrapes {
+		projectName := s.project.name
+		s.errs.summary()
+		synced = synced && s.errs.empty()
+		if !wanted("extended") {
+			continue
+		}
+
+		if collectLBBackends {
+			s.backends.set(projectName)
+		}
+
+		extendingStacksTotal.WithLabelValues(projectName).Set(float64(s.stacks.total))
+		extendingServicesTotal.WithLabelValues(projectName).Set(float64(s.services.total))
+		extendingInstancesTotal.WithLabelValues(projectName).Set(float64(s.instances.total))
+
+		if !hideSys {
+			extendingSystemObjectCount.WithLabelValues(projectName, "stack").Set(float64(s.stacks.system))
+			extendingSystemObjectCount.WithLabelValues(projectName, "service").Set(float64(s.services.system))
+			extendingSystemObjectCount.WithLabelValues(projectName, "instance").Set(float64(s.instances.system))
+
+			for objectType, counter := range map[string]*objectCounter{"stack": s.stacks, "service": s.services, "instance": s.instances} {
+				if counter.total > 0 {
+					extendingSystemObjectRatio.WithLabelValues(projectName, objectType).Set(float64(counter.system) / float64(counter.total))
+				}
+			}
+		}
+	}
+
+	// a filtered fetch does not tell whether the whole of Rancher is fetched
+	if complete {
+		// let the pusher push this fetch
+		select {
+		case r.fetched <- struct{}{}:
+		default:
+		}
+
+		if synced {
+			exporterScrapeSuccess.Set(1)
+			atomic.StoreInt32(&r.everSynced, 1)
+			r.infinityWorksStale = false
+			r.startupAverages.prune()
+			r.stackStates.prune()
+
+			// the hidden system instances are not fetched, so they cannot tell whether they are gone
+			r.bootstrapSeries.prune(func(labelValues []string) bool {
+				return hideSys && labelValues[4] == "true"
+			}, extendingInstanceBootstrapMsCost, extendingInstanceBootstrapSeconds)
+			pruneObjectCounters(scrapes)
+
+			// keep the complete states for the partial fetches afterwards
+			if strictScrape {
+				r.infinityWorksMetrics = gatherMetrics(infinityWorksHostsState, infinityWorksHostAgentsState, infinityWorksStacksHealth, infinityWorksStacksState, infinityWorksServicesScale, infinityWorksServicesHealth, infinityWorksServicesState)
+			}
+		} else {
+			exporterScrapeSuccess.Set(0)
+			r.infinityWorksStale = strictScrape && r.infinityWorksMetrics != nil
+		}
+	}
+
+	r.collectSyncMetrics(ch)
+}
+
+// pruneObjectCounters deletes the series of the extended counters whose stack, service or instance the scrape of
+// their environment has not seen, the __rancher__ series summing up an environment, stack or service are kept with it.
+// The counters are only fed by the events of the collected objects, so the hidden system objects have no series to keep.
+func pruneObjectCounters(scrapes []*syncScrape) {
+	seen := make(map[string]*objectSet, len(scrapes))
+	for _, s := range scrapes {
+		seen[s.project.name] = s.seen
+	}
+
+	for _, counter := range []*prometheus.CounterVec{
+		extendingTotalStackInitializations, extendingTotalSuccessStackInitialization, extendingTotalErrorStackInitialization,
+		extendingTotalServiceInitializations, extendingTotalSuccessServiceInitialization, extendingTotalErrorServiceInitialization,
+		extendingTotalInstanceInitializations, extendingTotalSuccessInstanceInitialization, extendingTotalErrorInstanceInitialization,
+		extendingTotalStackBootstraps, extendingTotalSuccessStackBootstrap, extendingTotalErrorStackBootstrap,
+		extendingTotalServiceBootstraps, extendingTotalSuccessServiceBootstrap, extendingTotalErrorServiceBootstrap,
+		extendingTotalInstanceBootstraps, extendingTotalSuccessInstanceBootstrap, extendingTotalErrorInstanceBootstrap,
+	} {
+		for _, metric := range gatherMetrics(counter) {
+			pb := &dto.Metric{}
+			metric.Write(pb)
+
+			labels := make(prometheus.Labels, len(pb.GetLabel()))
+			for _, labelPair := range pb.GetLabel() {
+				labels[labelPair.GetName()] = labelPair.GetValue()
+			}
+
+			objects, ok := seen[labels["environment_name"]]
+			if !ok {
+				continue
+			}
+
+			// the path of the most specific object the series counts, e.g. web/nginx for the service series of the web stack
+			var path []string
+			for _, labelName := range []string{"stack_name", "service_name", "name"} {
+				if value, ok := labels[labelName]; ok {
+					if value == specialTag {
+						break
+					}
+					path = append(path, value)
+				}
+			}
+
+			if len(path) != 0 && !objects.has(path...) {
+				counter.Delete(labels)
+			}
+		}
+	}
+}
+
+func (r *rancherExporter) syncHosts(s *syncScrape) {
+	s.eachData("hosts", cattleURL+"/projects/"+s.project.id+"/hosts", func(hostBytes []byte) {
+		if !selectedHost(hostBytes) {
+			return
+		}
+
+		hostName := getLabel(hostBytes, "name")
+		hostState, _ := jsonparser.GetString(hostBytes, "state")
+		hostId, _ := jsonparser.GetString(hostBytes, "id")
+		hostAgentState, _ := jsonparser.GetString(hostBytes, "agentState")
+
+		if len(hostName) == 0 {
+			hostName = getLabel(hostBytes, "hostname")
+		}
+
+		for _, y := range hostStates {
+			if sameState(hostState, y) {
+				infinityWorksHostsState.WithLabelValues(hostId, hostName, y).Set(1)
+			} else {
+				infinityWorksHostsState.WithLabelValues(hostId, hostName, y).Set(0)
+			}
+		}
+
+		for _, y := range agentStates {
+			if sameState(hostAgentState, y) {
+				infinityWorksHostAgentsState.WithLabelValues(hostId, hostName, y).Set(1)
+			} else {
+				infinityWorksHostAgentsState.WithLabelValues(hostId, hostName, y).Set(0)
+			}
+		}
+
+		if hostCPUCount, err := jsonparser.GetInt(hostBytes, "info", "cpuInfo", "count"); err == nil {
+			extendingHostCPUCores.WithLabelValues(hostId, hostName).Set(float64(hostCPUCount))
+		}
+
+		// the agents report the memory in MiB
+		if hostMemTotal, err := jsonparser.GetInt(hostBytes, "info", "memoryInfo", "memTotal"); err == nil {
+			extendingHostMemoryBytes.WithLabelValues(hostId, hostName).Set(float64(hostMemTotal) * 1024 * 1024)
+		}
+
+		if len(hostLabelKeys) != 0 {
+			labelValues := []string{hostId, hostName}
+			for _, key := range hostLabelKeys {
+				hostLabel, _ := jsonparser.GetString(hostBytes, "labels", key)
+				labelValues = append(labelValues, labelValue(hostLabel))
+			}
+			extendingHostLabels.WithLabelValues(labelValues...).Set(1)
+		}
+	})
+}
+
+// syncProjects tells whether Rancher API is up by listing the projects, the same as on startup.
+func (r *rancherExporter) syncProjects(s *syncScrape) {
+	projectsAddress := cattleURL + "/projects"
+
+	projectsRespBytes, err := s.api.get(projectsAddress)
+	if err != nil {
+		s.errs.add("projects", projectsAddress, err)
+		exporterRancherUp.WithLabelValues(stripCredentials(cattleURL)).Set(0)
+	} else if !isCollection("projects", projectsAddress, projectsRespBytes) {
+		exporterRancherUp.WithLabelValues(stripCredentials(cattleURL)).Set(0)
+	} else {
+		exporterRancherUp.WithLabelValues(stripCredentials(cattleURL)).Set(1)
+	}
+}
+
+// hostLabelName turns a host label key into a label name, e.g. io.rancher.host.os into label_io_rancher_host_os.
+func hostLabelName(key string) string {
+	return "label_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func newHostLabelsVec(keys []string) *prometheus.GaugeVec {
+	labelNames := []string{"id", "name"}
+	for _, key := range keys {
+		labelNames = append(labelNames, hostLabelName(key))
+	}
+
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_labels",
+		Help:      "The labels of hosts in Rancher picked by the host label keys, the value is always 1",
+	}, labelNames)
+}
+
+// selectedHost tells whether a host has all the labels of the host label selector.
+func selectedHost(hostBytes []byte) bool {
+	for key, value := range hostLabelSelector {
+		if hostLabel, err := jsonparser.GetString(hostBytes, "labels", key); err != nil || hostLabel != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// selectedStack tells whether a stack passes the stack filters, the exclude filter wins over the include one.
+func selectedStack(stackName string) bool {
+	if stackExclude != nil && stackExclude.MatchString(stackName) {
+		return false
+	}
+
+	return stackInclude == nil || stackInclude.MatchString(stackName)
+}
+
+// syncMembers counts the members of the environment, skipping when the API key may not list them.
+func (r *rancherExporter) syncMembers(s *syncScrape) {
+	membersAddress := cattleURL + "/projects/" + s.project.id + "/projectmembers?limit=100"
+
+	members := 0
+	pages := newPager()
+	for {
+		membersRespBytes, err := s.api.get(membersAddress)
+		if status := responseStatus(err); status == http.StatusUnauthorized || status == http.StatusForbidden {
+			log.Debugln(membersAddress, "cannot be listed, skipping the members")
+			return
+		} else if err != nil {
+			s.errs.add("projectmembers", membersAddress, err)
+			return
+		}
+
+		if _, dataType, _, err := jsonparser.Get(membersRespBytes, "data"); err != nil || dataType != jsonparser.Array {
+			log.Debugln(membersAddress, "cannot be listed, skipping the members")
+			return
+		}
+
+		jsonparser.ArrayEach(membersRespBytes, func(memberBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+			members++
+		}, "data")
+
+		if next, err := pages.next(membersAddress, membersRespBytes); err != nil {
+			s.errs.add("projectmembers", membersAddress, err)
+			return
+		} else if len(next) == 0 {
+			break
+		} else {
+			membersAddress = next
+		}
+	}
+
+	extendingEnvironmentMemberCount.WithLabelValues(s.project.name).Set(float64(members))
+}
+
+// syncStacksNested walks the stacks of the environment, then the services of every stack and the instances of every service.
+func (r *rancherExporter) syncStacksNested(s *syncScrape) {
+	stacksAddress := cattleURL + "/projects/" + s.project.id + "/stacks?limit=100&sort=id"
+	if hideSys {
+		stacksAddress += "&system=false"
+	}
+
+	// list the stacks, then the services of every stack and the instances of every service in bounded workers,
+	// a worker holds its fetch slot for its own requests only, so the workers never wait on each other
+	var stacks [][]byte
+	s.eachData("stacks", stacksAddress, func(stackBytes []byte) {
+		if stackName, _ := jsonparser.GetString(stackBytes, "name"); selectedStack(stackName) {
+			stacks = append(stacks, stackBytes)
+		}
+	})
+
+	stackServices := make([][]listedService, len(stacks))
+	stkwg := &sync.WaitGroup{}
+	for i, stackBytes := range stacks {
+		i, stackBytes := i, stackBytes
+		spawn(stkwg, func() {
+			stackId, stackName := r.syncStack(stackBytes, s)
+			if !s.withServices {
+				return
+			}
+
+			s.eachData("services", stackServicesAddress(stackId), func(serviceBytes []byte) {
+				stackServices[i] = append(stackServices[i], listedService{stackId, stackName, serviceBytes})
+			})
+		})
+	}
+	stkwg.Wait()
+
+	// bound the services fetching their instances within every stack, on top of the fetch slots,
+	// a service takes the place in its stack before a fetch slot, and the stacks are taken in turn,
+	// so a large stack neither holds the fetch slots waiting on itself nor keeps the other stacks waiting
+	svcLimiters := make([]chan struct{}, len(stackServices))
+	if maxStackConcurrency > 0 {
+		for i := range svcLimiters {
+			svcLimiters[i] = make(chan struct{}, maxStackConcurrency)
+		}
+	}
+
+	released := make(chan struct{}, 1)
+	next := make([]int, len(stackServices))
+	svcwg := &sync.WaitGroup{}
+	for pending := true; pending; {
+		pending = false
+		spawned := false
+		for i, services := range stackServices {
+			if next[i] >= len(services) {
+				continue
+			}
+			pending = true
+
+			// a stack at its bound is skipped until one of its services is done
+			svcLimiter := svcLimiters[i]
+			if svcLimiter != nil {
+				select {
+				case svcLimiter <- struct{}{}:
+				default:
+					continue
+				}
+			}
+			spawned = true
+
+			service := services[next[i]]
+			next[i]++
+			spawn(svcwg, func() {
+				if svcLimiter != nil {
+					defer func() {
+						<-svcLimiter
+						select {
+						case released <- struct{}{}:
+						default:
+						}
+					}()
+				}
+
+				serviceId, _ := jsonparser.GetString(service.serviceBytes, "id")
+				instancesAddress := serviceInstancesAddress(serviceId)
+
+				r.syncService(service.stackId, service.stackName, service.serviceBytes, s, func(cb func(instanceBytes []byte)) {
+					s.eachData("instances", instancesAddress, cb)
+				})
+			})
+		}
+
+		// every stack left is at its bound, wait for a service to be done
+		if pending && !spawned {
+			<-released
+		}
+	}
+	svcwg.Wait()
+}
+
+// stackServicesAddress lists the services of a stack, the system ones only when they are not hidden.
+func stackServicesAddress(stackId string) string {
+	address := cattleURL + "/stacks/" + stackId + "/services?limit=100&sort=id"
+	if hideSys {
+		address += "&system=false"
+	}
+
+	return address
+}
+
+// serviceInstancesAddress lists the instances of a service, the system ones only when they are not hidden.
+func serviceInstancesAddress(serviceId string) string {
+	address := cattleURL + "/services/" + serviceId + "/instances?limit=100&sort=id"
+	if hideSys {
+		address += "&system=false"
+	}
+	if filterRemovedInstances {
+		address += removedInstancesFilter
+	}
+
+	return address
+}
+
+// syncStacksFlat lists all the stacks, services and instances of the environment at once, then stitches them by the parent ids.
+func (r *rancherExporter) syncStacksFlat(s *syncScrape) {
+	projectAddress := cattleURL + "/projects/" + s.project.id
+	query := "?limit=100&sort=id"
+	if hideSys {
+		query += "&system=false"
+	}
+
+	instancesQuery := query
+	if filterRemovedInstances {
+		instancesQuery += removedInstancesFilter
+	}
+
+	serviceInstances := make(map[string][][]byte, 64)
+	stackServices := make(map[string][][]byte, 32)
+	if s.withServices {
+		s.eachData("instances", projectAddress+"/instances"+instancesQuery, func(instanceBytes []byte) {
+			jsonparser.ArrayEach(instanceBytes, func(serviceIdBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+				serviceId := string(serviceIdBytes)
+				serviceInstances[serviceId] = append(serviceInstances[serviceId], instanceBytes)
+			}, "serviceIds")
+		})
+
+		s.eachData("services", projectAddress+"/services"+query, func(serviceBytes []byte) {
+			stackId, _ := jsonparser.GetString(serviceBytes, "stackId")
+			stackServices[stackId] = append(stackServices[stackId], serviceBytes)
+		})
+	}
+
+	s.eachData("stacks", projectAddress+"/stacks"+query, func(stackBytes []byte) {
+		if stackName, _ := jsonparser.GetString(stackBytes, "name"); !selectedStack(stackName) {
+			return
+		}
+
+		stackId, stackName := r.syncStack(stackBytes, s)
+
+		for _, serviceBytes := range stackServices[stackId] {
+			serviceId, _ := jsonparser.GetString(serviceBytes, "id")
+			instances := serviceInstances[serviceId]
+
+			r.syncService(stackId, stackName, serviceBytes, s, func(cb func(instanceBytes []byte)) {
+				for _, instanceBytes := range instances {
+					cb(instanceBytes)
+				}
+			})
+		}
+	})
+}
+
+func (r *rancherExporter) syncStack(stackBytes []byte, s *syncScrape) (string, string) {
+	projectName := s.project.name
+
+	stackId, _ := jsonparser.GetString(stackBytes, "id")
+	stackName := getLabel(stackBytes, "name")
+	stackSystem, _ := jsonparser.GetUnsafeString(stackBytes, "system")
+	s.stacks.add(stackSystem)
+	stackType := getTypeLabel(stackBytes)
+	stackHealthState, _ := jsonparser.GetString(stackBytes, "healthState")
+	stackState, _ := jsonparser.GetString(stackBytes, "state")
+	s.seen.add(stackName)
+
+	for _, y := range healthStates {
+		if sameState(stackHealthState, y) {
+			infinityWorksStacksHealth.WithLabelValues(stackId, stackName, y, stackSystem).Set(1)
+		} else {
+			infinityWorksStacksHealth.WithLabelValues(stackId, stackName, y, stackSystem).Set(0)
+		}
+	}
+
+	for _, y := range stackStates {
+		if sameState(stackState, y) {
+			infinityWorksStacksState.WithLabelValues(stackId, stackName, y, stackSystem).Set(1)
+		} else {
+			infinityWorksStacksState.WithLabelValues(stackId, stackName, y, stackSystem).Set(0)
+		}
+	}
+
+	extendingStackHeartbeat.WithLabelValues(projectName, stackName, stackSystem, stackType).Set(float64(1))
+
+	if stuckThresholdSeconds > 0 {
+		stackStateSince := r.stackStates.observe(stackId, stackState)
+
+		switch stackState {
+		case "active", "inactive", "error", "removed", "purged":
+			extendingStackStuck.WithLabelValues(projectName, stackName).Set(0)
+		default:
+			if time.Since(stackStateSince) >= time.Duration(stuckThresholdSeconds)*time.Second {
+				extendingStackStuck.WithLabelValues(projectName, stackName).Set(1)
+			} else {
+				extendingStackStuck.WithLabelValues(projectName, stackName).Set(0)
+			}
+		}
+	}
+
+	return stackId, stackName
+}
+
+// syncService emits the metrics of a service, eachInstance calls back with every instance of the service.
+func (r *rancherExporter) syncService(stackId, stackName string, serviceBytes []byte, s *syncScrape, eachInstance func(cb func(instanceBytes []byte))) {
+	projectName := s.project.name
+
+	serviceId, _ := jsonparser.GetString(serviceBytes, "id")
+	serviceName := getLabel(serviceBytes, "name")
+	serviceSystem, _ := jsonparser.GetUnsafeString(serviceBytes, "system")
+	s.services.add(serviceSystem)
+	serviceType := getTypeLabel(serviceBytes)
+	serviceHealthState, _ := jsonparser.GetString(serviceBytes, "healthState")
+	serviceState, _ := jsonparser.GetString(serviceBytes, "state")
+	serviceScale, _ := jsonparser.GetInt(serviceBytes, "scale")
+	s.seen.add(stackName, serviceName)
+
+	infinityWorksServicesScale.WithLabelValues(serviceName, stackName, serviceSystem).Set(float64(serviceScale))
+	for _, y := range healthStates {
+		if sameState(serviceHealthState, y) {
+			infinityWorksServicesHealth.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(1)
+		} else {
+			infinityWorksServicesHealth.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(0)
+		}
+	}
+
+	for _, y := range serviceStates {
+		if sameState(serviceState, y) {
+			infinityWorksServicesState.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(1)
+		} else {
+			infinityWorksServicesState.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(0)
+		}
+	}
+
+	extendingServiceHeartbeat.WithLabelValues(projectName, stackName, serviceName, serviceSystem, serviceType).Set(float64(1))
+
+	if ownerLabelKey != "" {
+		if serviceOwner, _ := jsonparser.GetString(serviceBytes, "launchConfig", "labels", ownerLabelKey); len(serviceOwner) != 0 {
+			extendingServiceOwnerInfo.WithLabelValues(projectName, stackName, serviceName, serviceOwner).Set(1)
+		}
+	}
+
+	if serviceSelfLink {
+		if serviceLinksSelf, _ := jsonparser.GetString(serviceBytes, "links", "self"); len(serviceLinksSelf) != 0 {
+			extendingServiceSelfLink.WithLabelValues(projectName, stackName, serviceName, stripCredentials(serviceLinksSelf)).Set(1)
+		}
+	}
+
+	if probeEndpoints {
+		jsonparser.ArrayEach(serviceBytes, func(endpointBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+			endpointIP, _ := jsonparser.GetString(endpointBytes, "ipAddress")
+			endpointPort, _ := jsonparser.GetInt(endpointBytes, "port")
+			port := strconv.FormatInt(endpointPort, 10)
+
+			if r.probe(endpointIP, port) {
+				extendingServiceEndpointReachable.WithLabelValues(projectName, stackName, serviceName, endpointIP, port).Set(1)
+			} else {
+				extendingServiceEndpointReachable.WithLabelValues(projectName, stackName, serviceName, endpointIP, port).Set(0)
+			}
+		}, "publicEndpoints")
+	}
+
+	if collectLBBackends {
+		if serviceRawType, _ := jsonparser.GetString(serviceBytes, "type"); serviceRawType == "loadBalancerService" {
+			s.backends.addBalancer(stackName, serviceName, serviceSystem, serviceBytes)
+		}
+	}
+
+	serviceFetchStart := time.Now()
+	serviceRunning := int64(0)
+	serviceHealthy := int64(0)
+	serviceInstances := int64(0)
+	var serviceStartups []startupSample
+	eachInstance(func(instanceBytes []byte) {
+		instanceName := getLabel(instanceBytes, "name")
+		instanceSystem, _ := jsonparser.GetUnsafeString(instanceBytes, "system")
+		s.instances.add(instanceSystem)
+		s.seen.add(stackName, serviceName, instanceName)
+		instanceType := getTypeLabel(instanceBytes)
+		instanceFirstRunningTS, _ := jsonparser.GetInt(instanceBytes, "firstRunningTS")
+		instanceCreatedTS, _ := jsonparser.GetInt(instanceBytes, "createdTS")
+
+		instanceState, _ := jsonparser.GetString(instanceBytes, "state")
+		if instanceState != "removed" && instanceState != "purged" {
+			serviceInstances++
 		}
-	}()
+		if instanceState == "running" {
+			serviceRunning++
 
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+			// the instances without health check have no health state, they are serving as long as they run
+			if instanceHealthState, _ := jsonparser.GetString(instanceBytes, "healthState"); len(instanceHealthState) == 0 || instanceHealthState == "healthy" {
+				serviceHealthy++
+			}
+		}
 
-	infinityWorksHostsState.Reset()
-	infinityWorksHostAgentsState.Reset()
-	infinityWorksStacksHealth.Reset()
-	infinityWorksStacksState.Reset()
-	extendingStackHeartbeat.Reset()
-	infinityWorksServicesScale.Reset()
-	infinityWorksServicesHealth.Reset()
-	infinityWorksServicesState.Reset()
-	extendingServiceHeartbeat.Reset()
-	extendingInstanceHeartbeat.Reset()
-
-	hc := newHttpClient(60 * time.Second)
-	gwg := &sync.WaitGroup{}
+		// a first running before the creation comes from a skewed clock, such a startup cannot be measured
+		instanceStarted := instanceFirstRunningTS != 0 && instanceFirstRunningTS >= instanceCreatedTS
 
-	gwg.Add(1)
-	go func() {
-		defer gwg.Done()
+		if startupEMAAlpha > 0 && instanceStarted {
+			instanceId, _ := jsonparser.GetString(instanceBytes, "id")
+			serviceStartups = append(serviceStartups, startupSample{instanceId, float64(instanceFirstRunningTS - instanceCreatedTS)})
+		}
 
-		if hostsRespBytes, err := hc.get(cattleURL + "/hosts"); err != nil {
-			log.Warnln(err)
-		} else {
-			jsonparser.ArrayEach(hostsRespBytes, func(hostBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
-				hostName, _ := jsonparser.GetString(hostBytes, "name")
-				hostState, _ := jsonparser.GetString(hostBytes, "state")
-				hostId, _ := jsonparser.GetString(hostBytes, "id")
-				hostAgentState, _ := jsonparser.GetString(hostBytes, "agentState")
-
-				if len(hostName) == 0 {
-					hostName, _ = jsonparser.GetString(hostBytes, "hostname")
-				}
+		if !sampledInstance(stackName, serviceName, instanceName, instanceSystem) {
+			return
+		}
 
-				for _, y := range hostStates {
-					if hostState == y {
-						infinityWorksHostsState.WithLabelValues(hostId, hostName, y).Set(1)
-					} else {
-						infinityWorksHostsState.WithLabelValues(hostId, hostName, y).Set(0)
-					}
-				}
+		extendingInstanceHeartbeat.WithLabelValues(projectName, stackName, serviceName, instanceName, instanceSystem, instanceType).Set(float64(1))
 
-				for _, y := range agentStates {
-					if hostAgentState == y {
-						infinityWorksHostAgentsState.WithLabelValues(hostId, hostName, y).Set(1)
-					} else {
-						infinityWorksHostAgentsState.WithLabelValues(hostId, hostName, y).Set(0)
-					}
-				}
+		if instanceDataAge {
+			if instanceUpdatedTS, _ := jsonparser.GetInt(instanceBytes, "updatedTS"); instanceUpdatedTS != 0 {
+				extendingInstanceDataAge.WithLabelValues(projectName, stackName, serviceName, instanceName, instanceSystem, instanceType).Set(float64(time.Now().UnixNano()/int64(time.Millisecond)-instanceUpdatedTS) / 1000)
+			}
+		}
 
-			}, "data")
+		if instanceStarted {
+			r.setInstanceBootstrap(float64(instanceFirstRunningTS-instanceCreatedTS), projectName, stackName, serviceName, instanceName, instanceSystem, instanceType)
 		}
-	}()
 
-	gwg.Add(1)
-	go func() {
-		defer gwg.Done()
+		// the first start is not a restart
+		if instanceStartCount, err := jsonparser.GetInt(instanceBytes, "startCount"); err == nil {
+			instanceRestarts := instanceStartCount - 1
+			if instanceRestarts < 0 {
+				instanceRestarts = 0
+			}
+			extendingInstanceRestartCount.WithLabelValues(projectName, stackName, serviceName, instanceName, instanceSystem, instanceType).Set(float64(instanceRestarts))
+		}
 
-		stacksAddress := cattleURL + "/projects/" + projectId + "/stacks?limit=100&sort=id"
-		if hideSys {
-			stacksAddress += "&system=false"
+		// an instance created long ago which has never been running is most likely failing to be scheduled
+		if neverRunningGrace > 0 {
+			if instanceCreatedTS != 0 && instanceFirstRunningTS == 0 && time.Since(time.Unix(0, instanceCreatedTS*int64(time.Millisecond))) > neverRunningGrace {
+				extendingInstanceNeverRunning.WithLabelValues(projectName, stackName, serviceName, instanceName, instanceSystem, instanceType).Set(1)
+			} else {
+				extendingInstanceNeverRunning.WithLabelValues(projectName, stackName, serviceName, instanceName, instanceSystem, instanceType).Set(0)
+			}
 		}
+	})
+	// the flat engine has listed the instances of the whole environment already, there is nothing to time per service
+	if fetchEngine != "flat" {
+		exporterServiceFetchDuration.WithLabelValues(serviceSystem).Observe(time.Since(serviceFetchStart).Seconds())
+	}
 
-		stkwg := &sync.WaitGroup{}
-		for {
-			if stacksRespBytes, err := hc.get(stacksAddress); err != nil {
-				log.Errorln(stacksAddress, err)
-				break
+	if collectLBBackends {
+		s.backends.addBackends(serviceId, serviceHealthy, serviceInstances)
+	}
+
+	if startupEMAAlpha > 0 {
+		if serviceStartupEMA, ok := r.startupAverages.update(serviceId, serviceStartups); ok {
+			if useBaseUnits {
+				extendingServiceStartupSecondsEMA.WithLabelValues(projectName, stackName, serviceName, serviceSystem).Set(serviceStartupEMA / 1000)
 			} else {
-				jsonparser.ArrayEach(stacksRespBytes, func(stackBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+				extendingServiceStartupMsEMA.WithLabelValues(projectName, stackName, serviceName, serviceSystem).Set(serviceStartupEMA)
+			}
+		}
+	}
 
-					stkwg.Add(1)
-					go func() {
-						defer stkwg.Done()
-
-						stackId, _ := jsonparser.GetString(stackBytes, "id")
-						stackName, _ := jsonparser.GetString(stackBytes, "name")
-						stackSystem, _ := jsonparser.GetUnsafeString(stackBytes, "system")
-						stackType, _ := jsonparser.GetString(stackBytes, "type")
-						stackHealthState, _ := jsonparser.GetString(stackBytes, "healthState")
-						stackState, _ := jsonparser.GetString(stackBytes, "state")
-
-						for _, y := range healthStates {
-							if stackHealthState == y {
-								infinityWorksStacksHealth.WithLabelValues(stackId, stackName, y, stackSystem).Set(1)
-							} else {
-								infinityWorksStacksHealth.WithLabelValues(stackId, stackName, y, stackSystem).Set(0)
-							}
-						}
+	// a registering service is coming up, it is neither down nor healthy yet
+	if serviceState == "registering" {
+		extendingServiceRegistering.WithLabelValues(projectName, stackName, serviceName, serviceSystem).Set(1)
+	} else {
+		extendingServiceRegistering.WithLabelValues(projectName, stackName, serviceName, serviceSystem).Set(0)
+	}
 
-						for _, y := range stackStates {
-							if stackState == y {
-								infinityWorksStacksState.WithLabelValues(stackId, stackName, y, stackSystem).Set(1)
-							} else {
-								infinityWorksStacksState.WithLabelValues(stackId, stackName, y, stackSystem).Set(0)
-							}
-						}
+	extendingServiceInstancesRunning.WithLabelValues(serviceName, stackName, serviceSystem).Set(float64(serviceRunning))
 
-						extendingStackHeartbeat.WithLabelValues(projectName, stackName, stackSystem, stackType).Set(float64(1))
+	if serviceScale > 0 && serviceRunning == 0 && serviceState != "registering" {
+		extendingServiceDown.WithLabelValues(projectName, stackName, serviceName, serviceSystem).Set(1)
+	} else {
+		extendingServiceDown.WithLabelValues(projectName, stackName, serviceName, serviceSystem).Set(0)
+	}
 
-						servicesAddress := cattleURL + "/stacks/" + stackId + "/services?limit=100&sort=id"
-						if hideSys {
-							servicesAddress += "&system=false"
-						}
+	if serviceStatus {
+		extendingServiceStatus.WithLabelValues(projectName, stackName, serviceName, serviceSystem).Set(combineServiceStatus(serviceState, serviceHealthState, serviceScale, serviceRunning))
+	}
+}
 
-						svcwg := &sync.WaitGroup{}
-						for {
-							if servicesRespBytes, err := hc.get(servicesAddress); err != nil {
-								log.Errorln(servicesAddress, err)
-								break
-							} else {
-								jsonparser.ArrayEach(servicesRespBytes, func(serviceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
-
-									svcwg.Add(1)
-									go func() {
-										defer svcwg.Done()
-
-										serviceId, _ := jsonparser.GetString(serviceBytes, "id")
-										serviceName, _ := jsonparser.GetString(serviceBytes, "name")
-										serviceSystem, _ := jsonparser.GetUnsafeString(serviceBytes, "system")
-										serviceType, _ := jsonparser.GetString(serviceBytes, "type")
-										serviceHealthState, _ := jsonparser.GetString(serviceBytes, "healthState")
-										serviceState, _ := jsonparser.GetString(serviceBytes, "state")
-										serviceScale, _ := jsonparser.GetInt(serviceBytes, "scale")
-
-										infinityWorksServicesScale.WithLabelValues(serviceName, stackName, serviceSystem).Set(float64(serviceScale))
-										for _, y := range healthStates {
-											if serviceHealthState == y {
-												infinityWorksServicesHealth.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(1)
-											} else {
-												infinityWorksServicesHealth.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(0)
-											}
-										}
+func (r *rancherExporter) collectSyncMetrics(ch chan<- prometheus.Metric) {
+	if r.infinityWorksStale {
+		for _, m := range r.infinityWorksMetrics {
+			ch <- m
+		}
+	} else {
+		infinityWorksHostsState.Collect(ch)
+		infinityWorksHostAgentsState.Collect(ch)
+		infinityWorksStacksHealth.Collect(ch)
+		infinityWorksStacksState.Collect(ch)
+		infinityWorksServicesScale.Collect(ch)
+		infinityWorksServicesHealth.Collect(ch)
+		infinityWorksServicesState.Collect(ch)
+	}
 
-										for _, y := range serviceStates {
-											if serviceState == y {
-												infinityWorksServicesState.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(1)
-											} else {
-												infinityWorksServicesState.WithLabelValues(serviceId, stackId, serviceName, stackName, y, serviceSystem).Set(0)
-											}
-										}
+	extendingHostCPUCores.Collect(ch)
+	extendingHostMemoryBytes.Collect(ch)
+	extendingHostLabels.Collect(ch)
+	extendingStackHeartbeat.Collect(ch)
+	extendingStackStuck.Collect(ch)
+	extendingServiceHeartbeat.Collect(ch)
+	extendingInstanceHeartbeat.Collect(ch)
+	extendingServiceEndpointReachable.Collect(ch)
+	extendingServiceStatus.Collect(ch)
+	extendingServiceDown.Collect(ch)
+	extendingServiceInstancesRunning.Collect(ch)
+	extendingServiceRegistering.Collect(ch)
+	extendingServiceStartupMsEMA.Collect(ch)
+	extendingServiceStartupSecondsEMA.Collect(ch)
+	extendingProjectsTotal.Collect(ch)
+	extendingStacksTotal.Collect(ch)
+	extendingServicesTotal.Collect(ch)
+	extendingInstancesTotal.Collect(ch)
+	extendingSystemObjectCount.Collect(ch)
+	extendingSystemObjectRatio.Collect(ch)
+	extendingEnvironmentMemberCount.Collect(ch)
+	extendingInstanceDataAge.Collect(ch)
+	extendingInstanceNeverRunning.Collect(ch)
+	extendingInstanceRestartCount.Collect(ch)
+	extendingServiceOwnerInfo.Collect(ch)
+	extendingServiceSelfLink.Collect(ch)
+	extendingLBHealthyBackends.Collect(ch)
+	extendingLBTotalBackends.Collect(ch)
+	exporterServiceFetchDuration.Collect(ch)
+	exporterEnvironmentFetchDuration.Collect(ch)
+	exporterScrapeDuration.Collect(ch)
+	exporterScrapeSuccess.Collect(ch)
+	exporterRancherUp.Collect(ch)
+	exporterRateLimitWait.Collect(ch)
+	exporterRateLimit.Collect(ch)
+	exporterRateLimitBurst.Collect(ch)
+	exporterAPIRequestDuration.Collect(ch)
+	exporterAPIRequests.Collect(ch)
+	exporterScrapeCacheHits.Collect(ch)
+	exporterScrapeCacheMisses.Collect(ch)
+}
 
-										extendingServiceHeartbeat.WithLabelValues(projectName, stackName, serviceName, serviceSystem, serviceType).Set(float64(1))
+// adaptInterval keeps the scrape interval the factor above the fetch duration within the bounds,
+// it rises at once on a slower fetch but only falls halfway on a faster one, so a single quick fetch does not cause overlaps.
+func adaptInterval(current, fetchDuration time.Duration) time.Duration {
+	target := time.Duration(adaptiveIntervalFactor * float64(fetchDuration))
+	if target < current {
+		target = current - (current-target)/2
+	}
 
-										instancesAddress := cattleURL + "/services/" + serviceId + "/instances?limit=100&sort=id"
-										if hideSys {
-											instancesAddress += "&system=false"
-										}
+	if target < adaptiveIntervalMin {
+		return adaptiveIntervalMin
+	} else if target > adaptiveIntervalMax {
+		return adaptiveIntervalMax
+	}
+	return target
+}
 
-										for {
-											if instancesRespBytes, err := hc.get(instancesAddress); err != nil {
-												log.Errorln(instancesAddress, err)
-												break
-											} else {
-												jsonparser.ArrayEach(instancesRespBytes, func(instanceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
-													instanceName, _ := jsonparser.GetString(instanceBytes, "name")
-													instanceSystem, _ := jsonparser.GetUnsafeString(instanceBytes, "system")
-													instanceType, _ := jsonparser.GetString(instanceBytes, "type")
+// sampledInstance tells whether the per-instance gauges of an instance should be emitted,
+// the same instance is always either in or out of the sample.
+func sampledInstance(stackName, serviceName, instanceName, instanceSystem string) bool {
+	if instanceSystem == "true" && !instanceMetricsSystem {
+		return false
+	}
 
-													extendingInstanceHeartbeat.WithLabelValues(projectName, stackName, serviceName, instanceName, instanceSystem, instanceType).Set(float64(1))
+	if instanceSampleRate >= 1 {
+		return true
+	}
 
-													if instanceFirstRunningTS, _ := jsonparser.GetInt(instanceBytes, "firstRunningTS"); instanceFirstRunningTS != 0 {
-														instanceCreatedTS, _ := jsonparser.GetInt(instanceBytes, "createdTS")
-														extendingInstanceBootstrapMsCost.WithLabelValues(projectName, stackName, serviceName, instanceName, instanceSystem, instanceType).Set(float64(instanceFirstRunningTS - instanceCreatedTS))
-													}
+	h := fnv.New32a()
+	h.Write([]byte(stackName + "/" + serviceName + "/" + instanceName))
 
-												}, "data")
+	return float64(h.Sum32()) < instanceSampleRate*float64(1<<32)
+}
 
-												if next, _ := jsonparser.GetString(instancesRespBytes, "pagination", "next"); len(next) == 0 {
-													break
-												} else {
-													instancesAddress = next
-												}
+// labelValue truncates a name or type longer than the maximum label length, keeping a hash of the whole value as the suffix.
+func labelValue(value string) string {
+	if maxLabelLength <= 0 || len(value) <= maxLabelLength {
+		return value
+	}
 
-											}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	suffix := fmt.Sprintf("~%08x", h.Sum32())
 
-										}
+	// cut on a rune boundary
+	cut := maxLabelLength - len(suffix)
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
 
-									}()
+	exporterTruncatedLabels.Inc()
+	return value[:cut] + suffix
+}
 
-								}, "data")
+// getLabel reads a name or type to be used as a label value.
+func getLabel(dataBytes []byte, keys ...string) string {
+	value, _ := jsonparser.GetString(dataBytes, keys...)
 
-								if next, _ := jsonparser.GetString(servicesRespBytes, "pagination", "next"); len(next) == 0 {
-									break
-								} else {
-									servicesAddress = next
-								}
-							}
+	return labelValue(value)
+}
 
-						}
-						svcwg.Wait()
+// getTypeLabel reads a type to be used as a label value, mapped to the canonical type labels when they are enabled.
+func getTypeLabel(dataBytes []byte) string {
+	value, _ := jsonparser.GetString(dataBytes, "type")
 
-					}()
+	return typeLabel(value)
+}
 
-				}, "data")
+// typeLabel maps a Rancher type to its type label, the same for the API and the metadata service.
+func typeLabel(value string) string {
+	if label, ok := typeLabels[value]; ok {
+		value = label
+	}
 
-				if next, _ := jsonparser.GetString(stacksRespBytes, "pagination", "next"); len(next) == 0 {
-					break
-				} else {
-					stacksAddress = next
-				}
-			}
-		}
-		stkwg.Wait()
+	return labelValue(value)
+}
 
+func gatherMetrics(collectors ...prometheus.Collector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric, 64)
+	go func() {
+		defer close(ch)
+
+		for _, c := range collectors {
+			c.Collect(ch)
+		}
 	}()
 
-	gwg.Wait()
+	var result []prometheus.Metric
+	for m := range ch {
+		result = append(result, m)
+	}
 
-	// collect
-	infinityWorksHostsState.Collect(ch)
-	infinityWorksHostAgentsState.Collect(ch)
-	infinityWorksStacksHealth.Collect(ch)
-	infinityWorksStacksState.Collect(ch)
-	extendingStackHeartbeat.Collect(ch)
-	infinityWorksServicesScale.Collect(ch)
-	infinityWorksServicesHealth.Collect(ch)
-	infinityWorksServicesState.Collect(ch)
-	extendingServiceHeartbeat.Collect(ch)
-	extendingInstanceHeartbeat.Collect(ch)
+	return result
+}
+
+// setInstanceBootstrap sets the bootstrap time of an instance in seconds or, by default, in milliseconds.
+func (r *rancherExporter) setInstanceBootstrap(ms float64, labelValues ...string) {
+	r.bootstrapSeries.observe(labelValues)
+	if useBaseUnits {
+		extendingInstanceBootstrapSeconds.WithLabelValues(labelValues...).Set(ms / 1000)
+	} else {
+		extendingInstanceBootstrapMsCost.WithLabelValues(labelValues...).Set(ms)
+	}
+}
+
+// stripCredentials drops the user info a link may embed.
+func stripCredentials(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+
+	return u.String()
+}
+
+// sameState compares two states regardless of the hyphen or underscore spelling, e.g. updating-active and updating_active.
+func sameState(state, knownState string) bool {
+	return strings.Replace(state, "-", "_", -1) == strings.Replace(knownState, "-", "_", -1)
+}
+
+// combineServiceStatus folds the state, health state and running instances of a service into
+// 0 (down), 1 (degraded) or 2 (healthy).
+func combineServiceStatus(state, healthState string, scale, running int64) float64 {
+	switch {
+	case state == "registering":
+		return 1
+	case state == "inactive" || state == "error" || (scale > 0 && running == 0):
+		return 0
+	case state == "active" && (healthState == "healthy" || healthState == "started-once") && running >= scale:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (r *rancherExporter) probe(ip, port string) bool {
+	r.probeLimiter <- struct{}{}
+	defer func() {
+		<-r.probeLimiter
+	}()
 
+	conn, err := dialProbe("tcp", net.JoinHostPort(ip, port), probeTimeout)
+	if err != nil {
+		log.Debugln("cannot reach endpoint", ip, port, err)
+		return false
+	}
+	conn.Close()
+
+	return true
 }
 
-func (r *rancherExporter) collectingExtending() {
+func (r *rancherExporter) collectingExtending(project *rancherProject) {
 	glog := utils.GetGlobalLogger()
 
-	projectId := r.projectId
-	projectName := r.projectName
+	projectId := project.id
+	projectName := project.name
 
 	stackIdNameMap := &sync.Map{}
+	serviceIdSet := &sync.Map{}
+
+	// init removed
+	extendingTotalStackRemovals.WithLabelValues(projectName)
+	extendingTotalServiceRemovals.WithLabelValues(projectName)
 
 	go func() {
 
-		hc := newHttpClient(30 * time.Second)
+		hc := r.api.withEnvironment(projectId)
 		stacksAddress := cattleURL + "/projects/" + projectId + "/stacks?limit=100&sort=id"
 		if hideSys {
 			stacksAddress += "&system=false"
 		}
 
-		stkwg := &sync.WaitGroup{}
+		// list the stacks, then the services of every stack and the instances of every service in bounded workers,
+		// a worker holds its fetch slot for its own requests only, so the workers never wait on each other
+		var stacks [][]byte
+		stackPages := newPager()
 		for {
 			if stacksRespBytes, err := hc.get(stacksAddress); err != nil {
 				log.Errorln(stacksAddress, err)
 				break
+			} else if !isCollection("stacks", stacksAddress, stacksRespBytes) {
+				break
 			} else {
 				jsonparser.ArrayEach(stacksRespBytes, func(stackBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+					if stackName, _ := jsonparser.GetString(stackBytes, "name"); !selectedStack(stackName) {
+						return
+					}
 
-					stkwg.Add(1)
-					go func() {
-						defer stkwg.Done()
+					stacks = append(stacks, stackBytes)
+				}, "data")
 
-						stackId, _ := jsonparser.GetString(stackBytes, "id")
-						stackName, _ := jsonparser.GetString(stackBytes, "name")
-						stackHealthState, _ := jsonparser.GetString(stackBytes, "healthState")
-						stackState, _ := jsonparser.GetString(stackBytes, "state")
+				if next, err := stackPages.next(stacksAddress, stacksRespBytes); err != nil {
+					log.Warnln(stacksAddress, err)
+					break
+				} else if len(next) == 0 {
+					break
+				} else {
+					stacksAddress = next
+				}
+			}
+		}
 
-						stackIdNameMap.Store(stackId, stackName)
+		servicesMutex := &sync.Mutex{}
+		var services []listedService
+		stkwg := &sync.WaitGroup{}
+		for _, stackBytes := range stacks {
+			stackBytes := stackBytes
+			spawn(stkwg, func() {
+				stackId, _ := jsonparser.GetString(stackBytes, "id")
+				stackName := getLabel(stackBytes, "name")
+				stackHealthState, _ := jsonparser.GetString(stackBytes, "healthState")
+				stackState, _ := jsonparser.GetString(stackBytes, "state")
+
+				stackIdNameMap.Store(stackId, stackName)
+
+				// init bootstrap
+				extendingTotalStackBootstraps.WithLabelValues(projectName, specialTag)
+				extendingTotalStackBootstraps.WithLabelValues(projectName, stackName)
+				extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, specialTag)
+				extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, stackName)
+				extendingTotalErrorStackBootstrap.WithLabelValues(projectName, specialTag)
+				extendingTotalErrorStackBootstrap.WithLabelValues(projectName, stackName)
+
+				switch stackState {
+				case "active":
+					if stackHealthState == "unhealthy" {
+						extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
+						extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
+						extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag)
+						extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName)
+						extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag).Inc()
+						extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName).Inc()
+					} else if stackHealthState == "healthy" {
+						extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
+						extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
+						extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag).Inc()
+						extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName).Inc()
+						extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag)
+						extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName)
+					}
+				case "error":
+					extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
+					extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
+					extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag)
+					extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName)
+					extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag).Inc()
+					extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName).Inc()
+				}
 
-						// init bootstrap
-						extendingTotalStackBootstraps.WithLabelValues(projectName, specialTag)
-						extendingTotalStackBootstraps.WithLabelValues(projectName, stackName)
-						extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, specialTag)
-						extendingTotalSuccessStackBootstrap.WithLabelValues(projectName, stackName)
-						extendingTotalErrorStackBootstrap.WithLabelValues(projectName, specialTag)
-						extendingTotalErrorStackBootstrap.WithLabelValues(projectName, stackName)
-
-						switch stackState {
-						case "active":
-							if stackHealthState == "unhealthy" {
-								extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
-								extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
-								extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag)
-								extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName)
-								extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag).Inc()
-								extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName).Inc()
-							} else if stackHealthState == "healthy" {
-								extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
-								extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
-								extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag).Inc()
-								extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName).Inc()
-								extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag)
-								extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName)
-							}
-						case "error":
-							extendingTotalStackInitializations.WithLabelValues(projectName, specialTag).Inc()
-							extendingTotalStackInitializations.WithLabelValues(projectName, stackName).Inc()
-							extendingTotalSuccessStackInitialization.WithLabelValues(projectName, specialTag)
-							extendingTotalSuccessStackInitialization.WithLabelValues(projectName, stackName)
-							extendingTotalErrorStackInitialization.WithLabelValues(projectName, specialTag).Inc()
-							extendingTotalErrorStackInitialization.WithLabelValues(projectName, stackName).Inc()
-						}
+				servicesAddress := stackServicesAddress(stackId)
 
-						servicesAddress := cattleURL + "/stacks/" + stackId + "/services?limit=100&sort=id"
-						if hideSys {
-							servicesAddress += "&system=false"
+				servicePages := newPager()
+				for {
+					if servicesRespBytes, err := hc.get(servicesAddress); err != nil {
+						log.Errorln(servicesAddress, err)
+						break
+					} else if !isCollection("services", servicesAddress, servicesRespBytes) {
+						break
+					} else {
+						jsonparser.ArrayEach(servicesRespBytes, func(serviceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+							servicesMutex.Lock()
+							services = append(services, listedService{stackId, stackName, serviceBytes})
+							servicesMutex.Unlock()
+						}, "data")
+
+						if next, err := servicePages.next(servicesAddress, servicesRespBytes); err != nil {
+							log.Warnln(servicesAddress, err)
+							break
+						} else if len(next) == 0 {
+							break
+						} else {
+							servicesAddress = next
 						}
+					}
+				}
+			})
+		}
+		stkwg.Wait()
 
-						svcwg := &sync.WaitGroup{}
-						for {
-							if servicesRespBytes, err := hc.get(servicesAddress); err != nil {
-								log.Errorln(servicesAddress, err)
-								break
-							} else {
-								jsonparser.ArrayEach(servicesRespBytes, func(serviceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
-
-									svcwg.Add(1)
-									go func() {
-										defer svcwg.Done()
-
-										serviceId, _ := jsonparser.GetString(serviceBytes, "id")
-										serviceName, _ := jsonparser.GetString(serviceBytes, "name")
-										serviceHealthState, _ := jsonparser.GetString(serviceBytes, "healthState")
-										serviceState, _ := jsonparser.GetString(serviceBytes, "state")
-
-										extendingTotalServiceBootstraps.WithLabelValues(projectName, specialTag, specialTag)
-										extendingTotalServiceBootstraps.WithLabelValues(projectName, stackName, specialTag)
-										extendingTotalServiceBootstraps.WithLabelValues(projectName, stackName, serviceName)
-										extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag)
-										extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, stackName, specialTag)
-										extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, stackName, serviceName)
-										extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag)
-										extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, stackName, specialTag)
-										extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, stackName, serviceName)
-
-										switch serviceState {
-										case "active":
-											extendingTotalServiceInitializations.WithLabelValues(projectName, specialTag, specialTag).Inc()
-											extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, specialTag).Inc()
-											extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, serviceName).Inc()
-
-											if serviceHealthState == "unhealthy" {
-												extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
-												extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
-												extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
-												extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
-												extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
-												extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
-											} else if serviceHealthState == "healthy" {
-												extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
-												extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
-												extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
-												extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
-												extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
-												extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
-											}
-										case "error":
-											extendingTotalServiceInitializations.WithLabelValues(projectName, specialTag, specialTag).Inc()
-											extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, specialTag).Inc()
-											extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, serviceName).Inc()
-											extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
-											extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
-											extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
-											extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
-											extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
-											extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
-										}
-
-										instancesAddress := cattleURL + "/services/" + serviceId + "/instances?limit=100&sort=id"
-										if hideSys {
-											instancesAddress += "&system=false"
-										}
-
-										for {
-											if instancesRespBytes, err := hc.get(instancesAddress); err != nil {
-												log.Errorln(instancesAddress, err)
-												break
-											} else {
-												jsonparser.ArrayEach(instancesRespBytes, func(instanceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
-
-													instanceName, _ := jsonparser.GetString(instanceBytes, "name")
-													instanceSystem, _ := jsonparser.GetUnsafeString(instanceBytes, "system")
-													instanceType, _ := jsonparser.GetString(instanceBytes, "type")
-													instanceState, _ := jsonparser.GetString(instanceBytes, "state")
-													instanceFirstRunningTS, _ := jsonparser.GetInt(instanceBytes, "firstRunningTS")
-													instanceCreatedTS, _ := jsonparser.GetInt(instanceBytes, "createdTS")
-
-													extendingTotalInstanceBootstraps.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-													extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, specialTag, specialTag)
-													extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, serviceName, specialTag)
-													extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, serviceName, instanceName)
-													extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-													extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, specialTag, specialTag)
-													extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, specialTag)
-													extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, instanceName)
-													extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-													extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, specialTag, specialTag)
-													extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, specialTag)
-													extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, instanceName)
-
-													switch instanceState {
-													case "stopped":
-														fallthrough
-													case "running":
-														extendingTotalInstanceInitializations.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
-														extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, specialTag, specialTag).Inc()
-														extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, serviceName, specialTag).Inc()
-														extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, serviceName, instanceName).Inc()
-														extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
-														extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, specialTag, specialTag).Inc()
-														extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, specialTag).Inc()
-														extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, instanceName).Inc()
-														extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, specialTag, specialTag, specialTag)
-														extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, specialTag, specialTag)
-														extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, specialTag)
-														extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, instanceName)
-
-														if instanceFirstRunningTS != 0 {
-															instanceStartupTime := instanceFirstRunningTS - instanceCreatedTS
-															extendingInstanceBootstrapMsCost.WithLabelValues(projectName, stackName, serviceName, instanceName, instanceSystem, instanceType).Set(float64(instanceStartupTime))
-														}
-													}
-
-												}, "data")
-
-												if next, _ := jsonparser.GetString(instancesRespBytes, "pagination", "next"); len(next) == 0 {
-													break
-												} else {
-													instancesAddress = next
-												}
-
-											}
-
-										}
-
-									}()
-
-								}, "data")
+		svcwg := &sync.WaitGroup{}
+		for _, service := range services {
+			stackName, serviceBytes := service.stackName, service.serviceBytes
+			spawn(svcwg, func() {
+				serviceId, _ := jsonparser.GetString(serviceBytes, "id")
+				serviceName := getLabel(serviceBytes, "name")
+				serviceHealthState, _ := jsonparser.GetString(serviceBytes, "healthState")
+				serviceState, _ := jsonparser.GetString(serviceBytes, "state")
+
+				serviceIdSet.Store(serviceId, struct{}{})
+
+				extendingTotalServiceBootstraps.WithLabelValues(projectName, specialTag, specialTag)
+				extendingTotalServiceBootstraps.WithLabelValues(projectName, stackName, specialTag)
+				extendingTotalServiceBootstraps.WithLabelValues(projectName, stackName, serviceName)
+				extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag)
+				extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, stackName, specialTag)
+				extendingTotalSuccessServiceBootstrap.WithLabelValues(projectName, stackName, serviceName)
+				extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag)
+				extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, stackName, specialTag)
+				extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, stackName, serviceName)
+
+				switch serviceState {
+				case "active":
+					extendingTotalServiceInitializations.WithLabelValues(projectName, specialTag, specialTag).Inc()
+					extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, specialTag).Inc()
+					extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, serviceName).Inc()
+
+					if serviceHealthState == "unhealthy" {
+						extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
+						extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
+						extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
+						extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
+						extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
+						extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
+					} else if serviceHealthState == "healthy" {
+						extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
+						extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
+						extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
+						extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
+						extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
+						extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
+					}
+				case "error":
+					extendingTotalServiceInitializations.WithLabelValues(projectName, specialTag, specialTag).Inc()
+					extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, specialTag).Inc()
+					extendingTotalServiceInitializations.WithLabelValues(projectName, stackName, serviceName).Inc()
+					extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, specialTag, specialTag)
+					extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, specialTag)
+					extendingTotalSuccessServiceInitialization.WithLabelValues(projectName, stackName, serviceName)
+					extendingTotalErrorServiceInitialization.WithLabelValues(projectName, specialTag, specialTag).Inc()
+					extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, specialTag).Inc()
+					extendingTotalErrorServiceInitialization.WithLabelValues(projectName, stackName, serviceName).Inc()
+				case "registering":
+					// coming up, neither an initialization nor a failure yet
+				}
 
-								if next, _ := jsonparser.GetString(servicesRespBytes, "pagination", "next"); len(next) == 0 {
-									break
-								} else {
-									servicesAddress = next
+				instancesAddress := serviceInstancesAddress(serviceId)
+
+				instancePages := newPager()
+				for {
+					if instancesRespBytes, err := hc.get(instancesAddress); rancherError(err) && strings.Contains(instancesAddress, removedInstancesFilter) {
+						log.Debugln(instancesAddress, "does not support filtering the removed instances")
+						instancesAddress = strings.Replace(instancesAddress, removedInstancesFilter, "", -1)
+					} else if err != nil {
+						log.Errorln(instancesAddress, err)
+						break
+					} else if !isCollection("instances", instancesAddress, instancesRespBytes) {
+						break
+					} else {
+						jsonparser.ArrayEach(instancesRespBytes, func(instanceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+
+							instanceName := getLabel(instanceBytes, "name")
+							instanceSystem, _ := jsonparser.GetUnsafeString(instanceBytes, "system")
+							instanceType := getTypeLabel(instanceBytes)
+							instanceState, _ := jsonparser.GetString(instanceBytes, "state")
+							instanceFirstRunningTS, _ := jsonparser.GetInt(instanceBytes, "firstRunningTS")
+							instanceCreatedTS, _ := jsonparser.GetInt(instanceBytes, "createdTS")
+
+							extendingTotalInstanceBootstraps.WithLabelValues(projectName, specialTag, specialTag, specialTag)
+							extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, specialTag, specialTag)
+							extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, serviceName, specialTag)
+							extendingTotalInstanceBootstraps.WithLabelValues(projectName, stackName, serviceName, instanceName)
+							extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag)
+							extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, specialTag, specialTag)
+							extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, specialTag)
+							extendingTotalSuccessInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, instanceName)
+							extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, specialTag, specialTag, specialTag)
+							extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, specialTag, specialTag)
+							extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, specialTag)
+							extendingTotalErrorInstanceBootstrap.WithLabelValues(projectName, stackName, serviceName, instanceName)
+
+							switch instanceState {
+							case "stopped":
+								fallthrough
+							case "running":
+								extendingTotalInstanceInitializations.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
+								extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, specialTag, specialTag).Inc()
+								extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, serviceName, specialTag).Inc()
+								extendingTotalInstanceInitializations.WithLabelValues(projectName, stackName, serviceName, instanceName).Inc()
+								extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, specialTag, specialTag, specialTag).Inc()
+								extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, specialTag, specialTag).Inc()
+								extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, specialTag).Inc()
+								extendingTotalSuccessInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, instanceName).Inc()
+								extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, specialTag, specialTag, specialTag)
+								extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, specialTag, specialTag)
+								extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, specialTag)
+								extendingTotalErrorInstanceInitialization.WithLabelValues(projectName, stackName, serviceName, instanceName)
+
+								if instanceFirstRunningTS != 0 && instanceFirstRunningTS >= instanceCreatedTS && sampledInstance(stackName, serviceName, instanceName, instanceSystem) {
+									instanceStartupTime := instanceFirstRunningTS - instanceCreatedTS
+									r.setInstanceBootstrap(float64(instanceStartupTime), projectName, stackName, serviceName, instanceName, instanceSystem, instanceType)
 								}
 							}
 
-						}
-						svcwg.Wait()
+						}, "data")
 
-					}()
+						if next, err := instancePages.next(instancesAddress, instancesRespBytes); err != nil {
+							log.Warnln(instancesAddress, err)
+							break
+						} else if len(next) == 0 {
+							break
+						} else {
+							instancesAddress = next
+						}
 
-				}, "data")
+					}
 
-				if next, _ := jsonparser.GetString(stacksRespBytes, "pagination", "next"); len(next) == 0 {
-					break
-				} else {
-					stacksAddress = next
 				}
-			}
+			})
 		}
-		stkwg.Wait()
+		svcwg.Wait()
 
 		for {
-		recall:
-			_, messageBytes, err := r.websocketConn.ReadMessage()
-			if err != nil {
-				glog.Warnln("reconnect websocket")
-				r.websocketConn = r.recreateWebsocket()
-				goto recall
+			messageBytes, ok := project.events.read()
+			if !ok {
+				return
 			}
 
 			if resourceType, _ := jsonparser.GetString(messageBytes, "resourceType"); len(resourceType) != 0 {
@@ -835,18 +3432,29 @@ func (r *rancherExporter) collectingExtending() {
 					continue
 				}
 
+				// the hidden system objects are not loaded either, the scrapes could not tell when they are gone
+				if resourceSystem, _ := jsonparser.GetBoolean(resourceBytes, "system"); hideSys && resourceSystem {
+					continue
+				}
+
 				baseType, _ := jsonparser.GetString(resourceBytes, "baseType")
 				switch baseType {
 				case "stack":
 					id, _ := jsonparser.GetString(resourceBytes, "id")
-					name, _ := jsonparser.GetString(resourceBytes, "name")
+					name := getLabel(resourceBytes, "name")
 					state, _ := jsonparser.GetString(resourceBytes, "state")
 					healthState, _ := jsonparser.GetString(resourceBytes, "healthState")
 					transitioning, _ := jsonparser.GetString(resourceBytes, "transitioning")
 
-					stackIdNameMap.LoadOrStore(id, name)
+					if rawName, _ := jsonparser.GetString(resourceBytes, "name"); !selectedStack(rawName) {
+						continue
+					}
+
+					if state != "removed" {
+						stackIdNameMap.LoadOrStore(id, name)
+					}
 
-					r.stacksBuff <- buffMsg{
+					project.stacksBuff <- buffMsg{
 						id:            id,
 						name:          name,
 						state:         state,
@@ -854,8 +3462,9 @@ func (r *rancherExporter) collectingExtending() {
 						transitioning: transitioning,
 					}
 				case "service":
+					id, _ := jsonparser.GetString(resourceBytes, "id")
 					stackId, _ := jsonparser.GetString(resourceBytes, "stackId")
-					name, _ := jsonparser.GetString(resourceBytes, "name")
+					name := getLabel(resourceBytes, "name")
 					state, _ := jsonparser.GetString(resourceBytes, "state")
 					healthState, _ := jsonparser.GetString(resourceBytes, "healthState")
 					transitioning, _ := jsonparser.GetString(resourceBytes, "transitioning")
@@ -864,14 +3473,25 @@ func (r *rancherExporter) collectingExtending() {
 					if val, ok := stackIdNameMap.Load(stackId); ok {
 						stackName = val.(string)
 					} else if stackLink, err := jsonparser.GetString(resourceBytes, "links", "stack"); err == nil {
-						hc := newHttpClient(10 * time.Second)
-						if stackRespBytes, err := hc.get(stackLink); err == nil {
-							stackName, _ = jsonparser.GetString(stackRespBytes, "name")
+						ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+						stackRespBytes, err := hc.withContext(ctx).get(stackLink)
+						cancel()
+						if err == nil {
+							stackName = getLabel(stackRespBytes, "name")
 							stackIdNameMap.LoadOrStore(stackId, stackName)
 						}
 					}
 
-					r.servicesBuff <- buffMsg{
+					if !selectedStack(stackName) {
+						continue
+					}
+
+					if state != "removed" {
+						serviceIdSet.Store(id, struct{}{})
+					}
+
+					project.servicesBuff <- buffMsg{
+						id:            id,
 						name:          name,
 						state:         state,
 						healthState:   healthState,
@@ -879,21 +3499,24 @@ func (r *rancherExporter) collectingExtending() {
 						stackName:     stackName,
 					}
 				case "instance":
-					name, _ := jsonparser.GetString(resourceBytes, "name")
+					name := getLabel(resourceBytes, "name")
 					state, _ := jsonparser.GetString(resourceBytes, "state")
 					healthState, _ := jsonparser.GetString(resourceBytes, "healthState")
 					transitioning, _ := jsonparser.GetString(resourceBytes, "transitioning")
 					labelStackServiceName, _ := jsonparser.GetString(resourceBytes, "labels", "io.rancher.stack_service.name")
 
 					labelStackServiceNameSplit := strings.Split(labelStackServiceName, "/")
+					if !selectedStack(labelStackServiceNameSplit[0]) {
+						continue
+					}
 
-					r.instancesBuff <- buffMsg{
+					project.instancesBuff <- buffMsg{
 						name:          name,
 						state:         state,
 						healthState:   healthState,
 						transitioning: transitioning,
-						stackName:     labelStackServiceNameSplit[0],
-						serviceName:   labelStackServiceNameSplit[1],
+						stackName:     labelValue(labelStackServiceNameSplit[0]),
+						serviceName:   labelValue(labelStackServiceNameSplit[1]),
 					}
 				}
 			}
@@ -904,8 +3527,13 @@ func (r *rancherExporter) collectingExtending() {
 	go func() {
 		activatingStackLoop := make(map[string]int32, 16)
 
-		for stackMsg := range r.stacksBuff {
+		for stackMsg := range project.stacksBuff {
 			if stackMsg.state == "removed" {
+				if _, ok := stackIdNameMap.Load(stackMsg.id); ok {
+					extendingTotalStackRemovals.WithLabelValues(projectName).Inc()
+
+					glog.Infoln("stack [", stackMsg.name, "] removed + 1")
+				}
 				stackIdNameMap.Delete(stackMsg.id)
 				delete(activatingStackLoop, stackMsg.name)
 			} else if stackMsg.transitioning == "no" {
@@ -968,11 +3596,17 @@ func (r *rancherExporter) collectingExtending() {
 	go func() {
 		activatingServicesLoop := make(map[string]int32, 32)
 
-		for serviceMsg := range r.servicesBuff {
+		for serviceMsg := range project.servicesBuff {
 			stackName := serviceMsg.stackName
 			loopKey := stackName + "-" + serviceMsg.name
 
 			if serviceMsg.state == "removed" {
+				if _, ok := serviceIdSet.Load(serviceMsg.id); ok {
+					extendingTotalServiceRemovals.WithLabelValues(projectName).Inc()
+
+					glog.Infoln("service [", serviceMsg.name, "] removed + 1")
+				}
+				serviceIdSet.Delete(serviceMsg.id)
 				delete(activatingServicesLoop, loopKey)
 			} else if serviceMsg.transitioning == "no" {
 				if looping, ok := activatingServicesLoop[loopKey]; ok {
@@ -1034,7 +3668,7 @@ func (r *rancherExporter) collectingExtending() {
 					activatingServicesLoop[loopKey] = 0
 				}
 			} else {
-				if looping == 0 && serviceMsg.state == "updating-active" && serviceMsg.healthState == "unhealthy" { // error start
+				if looping == 0 && sameState(serviceMsg.state, "updating-active") && serviceMsg.healthState == "unhealthy" { // error start
 					extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, specialTag, specialTag).Inc()
 					extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, stackName, specialTag).Inc()
 					extendingTotalErrorServiceBootstrap.WithLabelValues(projectName, stackName, serviceMsg.name).Inc()
@@ -1062,7 +3696,7 @@ func (r *rancherExporter) collectingExtending() {
 		stoppedStopChan := make(chan string, 16)
 		defer close(stoppedStopChan)
 
-		for instanceMsg := range r.instancesBuff {
+		for instanceMsg := range project.instancesBuff {
 			if instanceMsg.state == "removed" {
 				activatingInstancesLoop.Delete(instanceMsg.name)
 			} else if instanceMsg.transitioning == "no" {
@@ -1180,66 +3814,194 @@ func (r *rancherExporter) collectingExtending() {
 	}()
 }
 
+// detectAPIBase picks the API base from the versions the server root lists.
+func detectAPIBase(serverURL string) (string, error) {
+	rootResponseBytes, err := newHttpClient(10 * time.Second).get(serverURL)
+	if err != nil {
+		return "", err
+	}
+
+	versions := make(map[string]bool, 4)
+	jsonparser.ArrayEach(rootResponseBytes, func(versionBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+		versionId, _ := jsonparser.GetString(versionBytes, "id")
+		versions[versionId] = true
+	}, "data")
+
+	switch {
+	case versions["v2-beta"]:
+		return "v2-beta", nil
+	case versions["v1"]:
+		return "", errors.New("the server only serves the v1 API, the v2-beta API of Rancher 1.2 or later is required")
+	default:
+		return "", errors.New("the server root does not list any API version")
+	}
+}
+
+func checkAPICompatibility(hc rancherAPI) error {
+	rootResponseBytes, err := hc.get(cattleURL)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot get API root, %v", err))
+	}
+
+	// Rancher 2.x answers with a Kubernetes flavored schema
+	if _, _, _, err := jsonparser.Get(rootResponseBytes, "links", "clusters"); err == nil {
+		return errors.New("the API looks like Rancher 2.x, only Rancher 1.x cattle API is supported")
+	}
+
+	for _, link := range []string{"projects", "hosts", "stacks"} {
+		if _, err := jsonparser.GetString(rootResponseBytes, "links", link); err != nil {
+			return errors.New(fmt.Sprintf("the API does not look like Rancher 1.x cattle API, missing %q link", link))
+		}
+	}
+
+	return nil
+}
+
+// selectProjects picks the projects allowed by the environments, skipping the others entirely,
+// only the first one without any environments.
+func selectProjects(projectsResponseBytes []byte) ([][]byte, error) {
+	if environments == nil {
+		projectBytes, _, _, err := jsonparser.Get(projectsResponseBytes, "data", "[0]")
+		return [][]byte{projectBytes}, err
+	}
+
+	var selected [][]byte
+	jsonparser.ArrayEach(projectsResponseBytes, func(projectBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+		projectId, _ := jsonparser.GetString(projectBytes, "id")
+		projectName, _ := jsonparser.GetString(projectBytes, "name")
+		if environments[projectId] || environments[projectName] {
+			selected = append(selected, projectBytes)
+		}
+	}, "data")
+
+	if len(selected) == 0 {
+		return nil, errors.New("no environment matches the environments")
+	}
+
+	return selected, nil
+}
+
+// checkEnvironmentCredentials checks that every environment having credentials of its own is listed by the projects.
+func checkEnvironmentCredentials(projectsResponseBytes []byte) error {
+	listed := make(map[string]bool, len(environmentCredentials))
+	jsonparser.ArrayEach(projectsResponseBytes, func(projectBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+		projectId, _ := jsonparser.GetString(projectBytes, "id")
+		listed[projectId] = true
+	}, "data")
+
+	for projectId := range environmentCredentials {
+		if !listed[projectId] {
+			return errors.New("environment_credentials names the environment " + projectId + " which does not exist")
+		}
+	}
+
+	return nil
+}
+
 func newRancherExporter() *rancherExporter {
+	exporterStartTime.Set(float64(time.Now().Unix()))
+	if hideSys {
+		exporterHideSystem.Set(1)
+	}
+	if requestRateLimiter != nil {
+		exporterRateLimit.Set(float64(requestRateLimiter.Limit()))
+		exporterRateLimitBurst.Set(float64(requestRateLimiter.Burst()))
+	}
+
 	hc := newHttpClient(10 * time.Second)
 
+	// check api
+	if err := checkAPICompatibility(hc); err != nil {
+		exporterAPICompatible.Set(0)
+		panic(errors.New(fmt.Sprintf("incompatible API %s, %v", cattleURL, err)))
+	}
+	exporterAPICompatible.Set(1)
+
 	// get project self link
 	projectsResponseBytes, err := hc.get(cattleURL + "/projects")
 	if err != nil {
 		panic(errors.New(fmt.Sprintf("cannot get project info, %v", err)))
 	}
 
-	projectBytes, _, _, err := jsonparser.Get(projectsResponseBytes, "data", "[0]")
+	projectsBytes, err := selectProjects(projectsResponseBytes)
 	if err != nil {
 		panic(errors.New(fmt.Sprintf("cannot get project, %v", err)))
 	}
-
-	projectId, err := jsonparser.GetString(projectBytes, "id")
-	if err != nil {
-		panic(errors.New(fmt.Sprintf("cannot get project id, %v", err)))
+	if err := checkEnvironmentCredentials(projectsResponseBytes); err != nil {
+		panic(err)
 	}
 
-	projectName, err := jsonparser.GetString(projectBytes, "name")
-	if err != nil {
-		panic(errors.New(fmt.Sprintf("cannot get project name, %v", err)))
-	}
+	projects := make([]*rancherProject, 0, len(projectsBytes))
+	for _, projectBytes := range projectsBytes {
+		projectId, err := jsonparser.GetString(projectBytes, "id")
+		if err != nil {
+			panic(errors.New(fmt.Sprintf("cannot get project id, %v", err)))
+		}
 
-	projectLinksSelf, err := jsonparser.GetString(projectBytes, "links", "self")
-	if err != nil {
-		panic(errors.New(fmt.Sprintf("cannot get project self address, %v", err)))
-	}
-	if strings.HasPrefix(projectLinksSelf, "http://") {
-		projectLinksSelf = strings.Replace(projectLinksSelf, "http://", "ws://", -1)
-	} else {
-		projectLinksSelf = strings.Replace(projectLinksSelf, "https://", "wss://", -1)
-	}
+		projectName, err := jsonparser.GetString(projectBytes, "name")
+		if err != nil {
+			panic(errors.New(fmt.Sprintf("cannot get project name, %v", err)))
+		}
 
-	wbsFactory := func() *websocket.Conn {
-		dialAddress := projectLinksSelf + "/subscribe?eventNames=resource.change&limit=-1&sockId=1"
-		httpHeaders := http.Header{}
-		httpHeaders.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(cattleAccessKey+":"+cattleSecretKey)))
-		wbs, _, err := websocket.DefaultDialer.Dial(dialAddress, httpHeaders)
+		projectLinksSelf, err := jsonparser.GetString(projectBytes, "links", "self")
 		if err != nil {
-			panic(err)
+			panic(errors.New(fmt.Sprintf("cannot get project self address, %v", err)))
+		}
+		if strings.HasPrefix(projectLinksSelf, "http://") {
+			projectLinksSelf = strings.Replace(projectLinksSelf, "http://", "ws://", -1)
+		} else {
+			projectLinksSelf = strings.Replace(projectLinksSelf, "https://", "wss://", -1)
+		}
+
+		wbsFactory := func() *websocket.Conn {
+			dialAddress := projectLinksSelf + "/subscribe?eventNames=resource.change&limit=-1&sockId=1"
+			httpHeaders := http.Header{}
+			httpHeaders.Add("Authorization", authorization(projectId))
+			dialer := *websocket.DefaultDialer
+			dialer.TLSClientConfig = rancherTLSConfig
+			wbs, _, err := dialer.Dial(dialAddress, httpHeaders)
+			if err != nil {
+				panic(err)
+			}
+
+			return wbs
 		}
 
-		return wbs
+		projects = append(projects, newRancherProject(projectId, labelValue(projectName), newWebsocketEvents(wbsFactory)))
 	}
 
-	result := &rancherExporter{
-		projectId:     projectId,
-		projectName:   projectName,
-		mutex:         &sync.Mutex{},
-		websocketConn: wbsFactory(),
+	result := newExporter(newHttpClient(60*time.Second), projects)
+	for _, project := range projects {
+		result.collectingExtending(project)
+	}
+	go result.watchInFlight()
 
-		stacksBuff:    make(chan buffMsg, 16),
-		servicesBuff:  make(chan buffMsg, 16),
-		instancesBuff: make(chan buffMsg, 16),
+	return result
+}
 
-		recreateWebsocket: wbsFactory,
+// newExporter builds the exporter of the environments on top of the given API, without fetching anything yet.
+func newExporter(api rancherAPI, projects []*rancherProject) *rancherExporter {
+	result := &rancherExporter{
+		projects: projects,
+		mutex:    &sync.Mutex{},
+		api:      api,
+
+		probeLimiter:    make(chan struct{}, probeConcurrency),
+		syncInterval:    minScrapeInterval,
+		startupAverages: newStartupAverages(),
+		stackStates:     newStateTracker(),
+		bootstrapSeries: newSeriesTracker(),
+		seriesDescs:     newSeriesDescs(),
+		objectDescs:     newObjectDescs(),
+		seriesMutex:     &sync.Mutex{},
+		stopped:         make(chan struct{}),
+		fetched:         make(chan struct{}, 1),
 	}
 
-	result.collectingExtending()
+	if adaptiveInterval {
+		result.syncInterval = adaptiveIntervalMin
+	}
+	exporterScrapeInterval.Set(result.syncInterval.Seconds())
 
 	return result
 }
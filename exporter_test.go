@@ -0,0 +1,1819 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/version"
+)
+
+// fakeAPI answers the gets with the canned JSON of the addresses, a 404 for the unknown ones.
+type fakeAPI struct {
+	mutex       *sync.Mutex
+	responses   map[string]string
+	requests    map[string]int
+	inFlight    int
+	maxInFlight int
+	delay       time.Duration
+}
+
+func (f *fakeAPI) get(address string) ([]byte, error) {
+	f.mutex.Lock()
+	f.requests[address]++
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	body, ok := f.responses[address]
+	delay := f.delay
+	f.mutex.Unlock()
+
+	defer func() {
+		f.mutex.Lock()
+		f.inFlight--
+		f.mutex.Unlock()
+	}()
+	time.Sleep(delay)
+
+	if !ok {
+		return nil, &statusError{http.StatusNotFound, []byte(`{"type":"error","status":404}`)}
+	}
+
+	return []byte(body), nil
+}
+
+func (f *fakeAPI) withContext(ctx context.Context) rancherAPI {
+	return f
+}
+
+func (f *fakeAPI) withEnvironment(projectId string) rancherAPI {
+	return f
+}
+
+func (f *fakeAPI) set(address, body string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.responses[address] = body
+}
+
+func (f *fakeAPI) requested(address string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.requests[address]
+}
+
+// peakInFlight reads the most requests in flight at the same time since the last call.
+func (f *fakeAPI) peakInFlight() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	peak := f.maxInFlight
+	f.maxInFlight = f.inFlight
+	return peak
+}
+
+func newFakeAPI(responses map[string]string) *fakeAPI {
+	return &fakeAPI{
+		mutex:     &sync.Mutex{},
+		responses: responses,
+		requests:  make(map[string]int),
+	}
+}
+
+// fakeEvents hands the events sent on the channel to the exporter.
+type fakeEvents struct {
+	events chan []byte
+}
+
+func (f *fakeEvents) read() ([]byte, bool) {
+	eventBytes, ok := <-f.events
+	return eventBytes, ok
+}
+
+func (f *fakeEvents) close() {
+	close(f.events)
+}
+
+func newFakeEvents() *fakeEvents {
+	return &fakeEvents{events: make(chan []byte, 16)}
+}
+
+// collection wraps the items into a Rancher collection.
+func collection(items ...string) string {
+	return `{"type":"collection","data":[` + strings.Join(items, ",") + `]}`
+}
+
+// fakeEnvironment is the Default environment with the web stack, its nginx service and one running instance.
+func fakeEnvironment() map[string]string {
+	return map[string]string{
+		cattleURL + "/projects":                                 collection(`{"id":"1a5","name":"Default","links":{"self":"http://rancher/v2-beta/projects/1a5"}}`),
+		cattleURL + "/projects/1a5/hosts":                       collection(`{"id":"1h1","name":"node-1","state":"active","agentState":"active"}`),
+		cattleURL + "/projects/1a5/stacks?limit=100&sort=id":    collection(`{"id":"1st1","name":"web","state":"active","healthState":"healthy","system":false,"type":"stack"}`),
+		cattleURL + "/stacks/1st1/services?limit=100&sort=id":   collection(`{"id":"1s1","name":"nginx","state":"active","healthState":"healthy","system":false,"type":"service","scale":1}`),
+		cattleURL + "/services/1s1/instances?limit=100&sort=id": collection(`{"id":"1i1","name":"web-nginx-1","state":"running","system":false,"type":"container","createdTS":1000,"firstRunningTS":3000,"startCount":1}`),
+		cattleURL + "/projects/1a5/projectmembers?limit=100":    collection(),
+		cattleURL + "/projects/1a5/stacks/1st1":                 `{"id":"1st1","name":"web","state":"active","healthState":"healthy","system":false,"type":"stack"}`,
+		cattleURL + "/projects/1a5/instances?limit=100&sort=id": collection(`{"id":"1i1","name":"web-nginx-1","state":"running","system":false,"type":"container","serviceIds":["1s1"],"createdTS":1000,"firstRunningTS":3000,"startCount":1}`),
+		cattleURL + "/projects/1a5/services?limit=100&sort=id":  collection(`{"id":"1s1","stackId":"1st1","name":"nginx","state":"active","healthState":"healthy","system":false,"type":"service","scale":1}`),
+	}
+}
+
+// setUpFlags sets the flags the tests depend on, the fake API answers under the cattle URL.
+func setUpFlags() {
+	cattleURL = "http://rancher/v2-beta"
+	fetchEngine = "nested"
+	hideSys = false
+	instanceSampleRate = 1
+	probeConcurrency = 1
+	minScrapeInterval = 0
+	scrapeTimeout = 0
+	adaptiveInterval = false
+	strictScrape = false
+	environments = nil
+	environmentCredentials = nil
+	stackInclude = nil
+	stackExclude = nil
+	metricPath = "/metrics"
+	disableCompression = false
+	debugEndpoints = false
+	retryMax = 0
+	serviceStatus = false
+	instanceMetricsSystem = false
+	useBaseUnits = false
+}
+
+func newTestExporter(api rancherAPI) *rancherExporter {
+	return newExporter(api, []*rancherProject{newRancherProject("1a5", "Default", newFakeEvents())})
+}
+
+// newTestServer serves the handler of the exporter, which is the only collector of its registry.
+func newTestServer(r *rancherExporter) *httptest.Server {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(r)
+
+	return httptest.NewServer(newHandler(r, registry))
+}
+
+// scrape runs one synchronous fetch of the exporter, dropping the collected metrics.
+func scrape(r *rancherExporter) {
+	ch := make(chan prometheus.Metric, 64)
+	go func() {
+		defer close(ch)
+
+		r.syncMetrics(ch, nil)
+	}()
+
+	for range ch {
+	}
+}
+
+// seriesValue reads the series of a collector having all the given labels.
+func seriesValue(c prometheus.Collector, labels prometheus.Labels) (float64, bool) {
+	for _, metric := range gatherMetrics(c) {
+		pb := &dto.Metric{}
+		metric.Write(pb)
+
+		matched := 0
+		for _, labelPair := range pb.GetLabel() {
+			if value, ok := labels[labelPair.GetName()]; ok && value == labelPair.GetValue() {
+				matched++
+			}
+		}
+		if matched != len(labels) {
+			continue
+		}
+
+		if pb.Counter != nil {
+			return pb.GetCounter().GetValue(), true
+		}
+		return pb.GetGauge().GetValue(), true
+	}
+
+	return 0, false
+}
+
+func TestSyncMetrics(t *testing.T) {
+	setUpFlags()
+	api := newFakeAPI(fakeEnvironment())
+	r := newTestExporter(api)
+
+	scrape(r)
+
+	if value, ok := seriesValue(exporterScrapeSuccess, nil); !ok || value != 1 {
+		t.Errorf("scrape success is %v, want 1", value)
+	}
+
+	for _, expected := range []struct {
+		collector prometheus.Collector
+		labels    prometheus.Labels
+	}{
+		{extendingStackHeartbeat, prometheus.Labels{"environment_name": "Default", "name": "web"}},
+		{extendingServiceHeartbeat, prometheus.Labels{"environment_name": "Default", "stack_name": "web", "name": "nginx"}},
+		{extendingInstanceHeartbeat, prometheus.Labels{"environment_name": "Default", "stack_name": "web", "service_name": "nginx", "name": "web-nginx-1"}},
+		{infinityWorksHostsState, prometheus.Labels{"id": "1h1", "name": "node-1", "state": "active"}},
+		{extendingInstancesTotal, prometheus.Labels{"environment_name": "Default"}},
+	} {
+		if value, ok := seriesValue(expected.collector, expected.labels); !ok || value != 1 {
+			t.Errorf("series %v is %v (found %v), want 1", expected.labels, value, ok)
+		}
+	}
+
+	if requests := api.requested(cattleURL + "/services/1s1/instances?limit=100&sort=id"); requests != 1 {
+		t.Errorf("the instances of the service are fetched %d times, want once", requests)
+	}
+}
+
+// fakeLargeEnvironment is the Default environment with the given stacks, each with the given services of one instance.
+func fakeLargeEnvironment(stacks, services int) map[string]string {
+	responses := map[string]string{
+		cattleURL + "/projects":           collection(`{"id":"1a5","name":"Default"}`),
+		cattleURL + "/projects/1a5/hosts": collection(),
+	}
+
+	var stackItems []string
+	for i := 0; i < stacks; i++ {
+		stackId := fmt.Sprintf("1st%d", i)
+		stackItems = append(stackItems, fmt.Sprintf(`{"id":%q,"name":"stack-%d","state":"active","healthState":"healthy"}`, stackId, i))
+
+		var serviceItems []string
+		for j := 0; j < services; j++ {
+			serviceId := fmt.Sprintf("1s%d-%d", i, j)
+			serviceItems = append(serviceItems, fmt.Sprintf(`{"id":%q,"name":"service-%d","state":"active","healthState":"healthy","scale":1}`, serviceId, j))
+			responses[cattleURL+"/services/"+serviceId+"/instances?limit=100&sort=id"] = collection(fmt.Sprintf(`{"id":"1i%d-%d","name":"instance-%d-%d","state":"running"}`, i, j, i, j))
+		}
+		responses[cattleURL+"/stacks/"+stackId+"/services?limit=100&sort=id"] = collection(serviceItems...)
+	}
+	responses[cattleURL+"/projects/1a5/stacks?limit=100&sort=id"] = collection(stackItems...)
+
+	return responses
+}
+
+// slotsAPI records the most fetch slots taken while listing the instances.
+type slotsAPI struct {
+	*fakeAPI
+	peakSlots int
+}
+
+func (s *slotsAPI) get(address string) ([]byte, error) {
+	if strings.Contains(address, "/instances") {
+		s.mutex.Lock()
+		if slots := len(fetchLimiter); slots > s.peakSlots {
+			s.peakSlots = slots
+		}
+		s.mutex.Unlock()
+	}
+
+	return s.fakeAPI.get(address)
+}
+
+func (s *slotsAPI) withContext(ctx context.Context) rancherAPI {
+	return s
+}
+
+func (s *slotsAPI) withEnvironment(projectId string) rancherAPI {
+	return s
+}
+
+func TestStackConcurrencyLimit(t *testing.T) {
+	setUpFlags()
+	fetchLimiter = make(chan struct{}, 3)
+	defer func(limit int) {
+		fetchLimiter, maxStackConcurrency = nil, limit
+	}(maxStackConcurrency)
+	maxStackConcurrency = 1
+
+	api := &slotsAPI{fakeAPI: newFakeAPI(fakeLargeEnvironment(1, 4))}
+	api.delay = 5 * time.Millisecond
+	r := newTestExporter(api)
+	defer r.Stop()
+
+	scrape(r)
+	// the services waiting on their stack do not take the fetch slots
+	if api.peakSlots != 1 {
+		t.Errorf("the instances of one stack are listed with %d fetch slots taken, want 1", api.peakSlots)
+	}
+	if value, ok := seriesValue(extendingInstancesTotal, nil); !ok || value != 4 {
+		t.Errorf("the scrape counts %v instances, want 4", value)
+	}
+}
+
+func TestFetchConcurrencyLimit(t *testing.T) {
+	setUpFlags()
+	fetchLimiter = make(chan struct{}, 3)
+	defer func() {
+		fetchLimiter = nil
+	}()
+
+	api := newFakeAPI(fakeLargeEnvironment(4, 6))
+	api.delay = 5 * time.Millisecond
+	r := newTestExporter(api)
+	defer r.Stop()
+
+	scrape(r)
+	// the hosts and the projects are fetched beside the stacks, outside of the fetch workers
+	if peak := api.peakInFlight(); peak > 3+2 {
+		t.Errorf("the scrape has %d requests in flight, want at most 5", peak)
+	}
+	if value, ok := seriesValue(extendingInstancesTotal, nil); !ok || value != 24 {
+		t.Errorf("the scrape counts %v instances, want 24", value)
+	}
+
+	r.collectingExtending(r.projects[0])
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 6; j++ {
+			instancesAddress := fmt.Sprintf("%s/services/1s%d-%d/instances?limit=100&sort=id", cattleURL, i, j)
+			for deadline := time.Now().Add(5 * time.Second); api.requested(instancesAddress) < 2; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("the initial load of the extended metrics does not fetch", instancesAddress)
+				}
+			}
+		}
+	}
+	if peak := api.peakInFlight(); peak > 3 {
+		t.Errorf("the initial load has %d requests in flight, want at most 3", peak)
+	}
+}
+
+func TestEnvironmentsFilter(t *testing.T) {
+	setUpFlags()
+	environments = map[string]bool{"Default": true, "Production": true}
+	defer func() {
+		environments = nil
+	}()
+
+	responses := make(map[string]string)
+	var projectItems []string
+	for _, project := range []struct{ id, name string }{{"1a5", "Default"}, {"1a6", "Staging"}, {"1a7", "Production"}} {
+		projectItems = append(projectItems, fmt.Sprintf(`{"id":%q,"name":%q}`, project.id, project.name))
+
+		stackId := "1st-" + project.id
+		responses[cattleURL+"/projects/"+project.id+"/hosts"] = collection()
+		responses[cattleURL+"/projects/"+project.id+"/stacks?limit=100&sort=id"] = collection(fmt.Sprintf(`{"id":%q,"name":"web","state":"active","healthState":"healthy"}`, stackId))
+		responses[cattleURL+"/stacks/"+stackId+"/services?limit=100&sort=id"] = collection()
+	}
+	responses[cattleURL+"/projects"] = collection(projectItems...)
+
+	projectsBytes, err := selectProjects([]byte(responses[cattleURL+"/projects"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var projects []*rancherProject
+	for _, projectBytes := range projectsBytes {
+		projectId, _ := jsonparser.GetString(projectBytes, "id")
+		projectName, _ := jsonparser.GetString(projectBytes, "name")
+		projects = append(projects, newRancherProject(projectId, projectName, newFakeEvents()))
+	}
+	if len(projects) != 2 {
+		t.Fatalf("%d environments are selected, want 2", len(projects))
+	}
+
+	api := newFakeAPI(responses)
+	scrape(newExporter(api, projects))
+
+	for _, projectName := range []string{"Default", "Production"} {
+		if _, ok := seriesValue(extendingStackHeartbeat, prometheus.Labels{"environment_name": projectName, "name": "web"}); !ok {
+			t.Errorf("the web stack of %s is not collected", projectName)
+		}
+	}
+	if _, ok := seriesValue(extendingStackHeartbeat, prometheus.Labels{"environment_name": "Staging"}); ok {
+		t.Error("the stacks of Staging are collected")
+	}
+	if requests := api.requested(cattleURL + "/projects/1a6/stacks?limit=100&sort=id"); requests != 0 {
+		t.Errorf("the stacks of Staging are fetched %d times, want never", requests)
+	}
+}
+
+func TestPruneVanishedService(t *testing.T) {
+	setUpFlags()
+	responses := fakeEnvironment()
+	responses[cattleURL+"/stacks/1st1/services?limit=100&sort=id"] = collection(
+		`{"id":"1s1","name":"nginx","state":"active","healthState":"healthy","scale":1}`,
+		`{"id":"1s2","name":"redis","state":"active","healthState":"healthy","scale":1}`,
+	)
+	responses[cattleURL+"/services/1s2/instances?limit=100&sort=id"] = collection(`{"id":"1i2","name":"web-redis-1","state":"running"}`)
+	api := newFakeAPI(responses)
+	r := newTestExporter(api)
+
+	// the events have counted a bootstrap of both services
+	for _, serviceName := range []string{"nginx", "redis"} {
+		extendingTotalServiceBootstraps.WithLabelValues("Default", specialTag, specialTag).Inc()
+		extendingTotalServiceBootstraps.WithLabelValues("Default", "web", specialTag).Inc()
+		extendingTotalServiceBootstraps.WithLabelValues("Default", "web", serviceName).Inc()
+		extendingTotalInstanceBootstraps.WithLabelValues("Default", "web", serviceName, "web-"+serviceName+"-1").Inc()
+	}
+
+	scrape(r)
+	redis := prometheus.Labels{"environment_name": "Default", "stack_name": "web", "name": "redis"}
+	if _, ok := seriesValue(extendingTotalServiceBootstraps, redis); !ok {
+		t.Fatal("the bootstraps of redis are pruned while it exists")
+	}
+	if _, ok := seriesValue(extendingInstanceHeartbeat, prometheus.Labels{"name": "web-redis-1"}); !ok {
+		t.Fatal("the heartbeat of web-redis-1 is missing while it exists")
+	}
+
+	api.set(cattleURL+"/stacks/1st1/services?limit=100&sort=id", collection(`{"id":"1s1","name":"nginx","state":"active","healthState":"healthy","scale":1}`))
+	scrape(r)
+
+	for _, gone := range []struct {
+		collector prometheus.Collector
+		labels    prometheus.Labels
+	}{
+		{extendingTotalServiceBootstraps, redis},
+		{extendingTotalInstanceBootstraps, prometheus.Labels{"service_name": "redis"}},
+		{extendingServiceHeartbeat, redis},
+		{extendingInstanceHeartbeat, prometheus.Labels{"name": "web-redis-1"}},
+		{infinityWorksServicesScale, prometheus.Labels{"stack_name": "web", "name": "redis"}},
+	} {
+		if _, ok := seriesValue(gone.collector, gone.labels); ok {
+			t.Errorf("the series %v of the removed redis are kept", gone.labels)
+		}
+	}
+
+	for _, kept := range []prometheus.Labels{
+		{"environment_name": "Default", "stack_name": "web", "name": "nginx"},
+		{"environment_name": "Default", "stack_name": "web", "name": specialTag},
+		{"environment_name": "Default", "stack_name": specialTag, "name": specialTag},
+	} {
+		if _, ok := seriesValue(extendingTotalServiceBootstraps, kept); !ok {
+			t.Errorf("the series %v are pruned", kept)
+		}
+	}
+}
+
+// serviceEvent is a resource change event of a service in the web stack.
+func serviceEvent(name, state, healthState, transitioning string) []byte {
+	return []byte(fmt.Sprintf(`{"resourceType":"service","data":{"resource":{"baseType":"service","id":"1s-%s","stackId":"1st1","name":%q,"state":%q,"healthState":%q,"transitioning":%q,"links":{"stack":%q}}}}`,
+		name, name, state, healthState, transitioning, cattleURL+"/projects/1a5/stacks/1st1"))
+}
+
+// waitSeries waits for the series of a collector having all the given labels to reach the value.
+func waitSeries(t *testing.T, c prometheus.Collector, labels prometheus.Labels, expected float64) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if value, _ := seriesValue(c, labels); value == expected {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("the series %v is %v, want %v", labels, value, expected)
+		}
+	}
+}
+
+func TestUpdatingActiveSpellings(t *testing.T) {
+	setUpFlags()
+
+	for i, state := range []string{"updating-active", "updating_active"} {
+		responses := fakeEnvironment()
+		responses[cattleURL+"/stacks/1st1/services?limit=100&sort=id"] = collection(fmt.Sprintf(`{"id":"1s1","name":"nginx","state":%q,"healthState":"healthy","scale":1}`, state))
+		r := newTestExporter(newFakeAPI(responses))
+
+		scrape(r)
+		if value, ok := seriesValue(infinityWorksServicesState, prometheus.Labels{"name": "nginx", "state": "updating_active"}); !ok || value != 1 {
+			t.Errorf("the state of a service %s is %v, want updating_active", state, value)
+		}
+
+		// an unhealthy update of a starting service fails its bootstrap
+		serviceName := fmt.Sprintf("api-%d", i)
+		r.collectingExtending(r.projects[0])
+		events := r.projects[0].events.(*fakeEvents)
+		events.events <- serviceEvent(serviceName, "activating", "healthy", "yes")
+		events.events <- serviceEvent(serviceName, state, "unhealthy", "yes")
+		waitSeries(t, extendingTotalErrorServiceBootstrap, prometheus.Labels{"environment_name": "Default", "stack_name": "web", "name": serviceName}, 1)
+
+		r.Stop()
+	}
+}
+
+func TestObjectTotals(t *testing.T) {
+	setUpFlags()
+	r := newTestExporter(newFakeAPI(fakeLargeEnvironment(3, 4)))
+
+	scrape(r)
+
+	if value, ok := seriesValue(extendingProjectsTotal, nil); !ok || value != 1 {
+		t.Errorf("rancher_projects_total is %v, want 1", value)
+	}
+	for _, expected := range []struct {
+		name      string
+		collector prometheus.Collector
+		count     float64
+	}{
+		{"rancher_stacks_total", extendingStacksTotal, 3},
+		{"rancher_services_total", extendingServicesTotal, 12},
+		{"rancher_instances_total", extendingInstancesTotal, 12},
+	} {
+		if value, ok := seriesValue(expected.collector, prometheus.Labels{"environment_name": "Default"}); !ok || value != expected.count {
+			t.Errorf("%s is %v, want %v", expected.name, value, expected.count)
+		}
+	}
+}
+
+func TestDebugAuth(t *testing.T) {
+	debugAuthUser, debugAuthPassword, debugAuthToken = "admin", "secret", "token"
+	defer func() {
+		debugAuthUser, debugAuthPassword, debugAuthToken = "", "", ""
+	}()
+
+	handler := requireDebugAuth(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	for _, c := range []struct {
+		name          string
+		authorization func(req *http.Request)
+		status        int
+	}{
+		{"no credentials", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"wrong token", func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{"basic auth", func(req *http.Request) { req.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"bearer token", func(req *http.Request) { req.Header.Set("Authorization", "Bearer token") }, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/debug/stack?id=1st1", nil)
+		c.authorization(req)
+		recorder := httptest.NewRecorder()
+
+		handler(recorder, req)
+		if recorder.Code != c.status {
+			t.Errorf("%s is answered %d, want %d", c.name, recorder.Code, c.status)
+		}
+	}
+}
+
+func TestProbeConcurrencyLimit(t *testing.T) {
+	setUpFlags()
+	probeConcurrency = 3
+	r := newTestExporter(newFakeAPI(nil))
+
+	mutex := &sync.Mutex{}
+	inFlight, maxInFlight := 0, 0
+	dialProbe = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		return nil, errors.New("refused")
+	}
+	defer func() {
+		dialProbe = net.DialTimeout
+	}()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r.probe(fmt.Sprintf("10.0.0.%d", i), "80")
+		}(i)
+	}
+	wg.Wait()
+
+	if maxInFlight > 3 {
+		t.Errorf("%d endpoints are dialed at the same time, want at most 3", maxInFlight)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		statusCode int
+		err        error
+		retryable  bool
+	}{
+		{"429", http.StatusTooManyRequests, &statusError{http.StatusTooManyRequests, nil}, true},
+		{"503", http.StatusServiceUnavailable, &statusError{http.StatusServiceUnavailable, nil}, true},
+		{"401", http.StatusUnauthorized, &statusError{http.StatusUnauthorized, nil}, false},
+		{"404", http.StatusNotFound, &statusError{http.StatusNotFound, nil}, false},
+		{"timeout", 0, &url.Error{Op: "Get", URL: "http://rancher", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, true},
+		{"refused", 0, &url.Error{Op: "Get", URL: "http://rancher", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}}, true},
+		{"reset", 200, &net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, true},
+		{"unknown host", 0, &url.Error{Op: "Get", URL: "http://rancher", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "rancher"}}}, false},
+		{"canceled", 0, &url.Error{Op: "Get", URL: "http://rancher", Err: context.Canceled}, false},
+		{"other", 0, errors.New("unexpected EOF"), false},
+	} {
+		if retryable := retryable(c.statusCode, c.err); retryable != c.retryable {
+			t.Errorf("%s is retryable %v, want %v", c.name, retryable, c.retryable)
+		}
+	}
+}
+
+func TestAPIBytesReadOnTheWire(t *testing.T) {
+	setUpFlags()
+	body := []byte(`{"data":[` + strings.Repeat(`{"type":"service","state":"active"},`, 100) + `{}]}`)
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(body)
+	gzipWriter.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("the request accepts %q, want gzip", req.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	before, _ := seriesValue(exporterAPIBytesRead, nil)
+	bs, err := newHttpClient(5 * time.Second).get(server.URL + "/v2-beta/projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, body) {
+		t.Errorf("the body is not decompressed: %s", bs)
+	}
+
+	after, _ := seriesValue(exporterAPIBytesRead, nil)
+	if read := after - before; read != float64(compressed.Len()) {
+		t.Errorf("%v bytes are counted, want the %d compressed bytes rather than the %d decoded ones", read, compressed.Len(), len(body))
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	setUpFlags()
+	body := []byte(collection(`{"id":"1a5","name":"Default"}`))
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(body)
+	gzipWriter.Close()
+
+	// a server may leave the body as it is although gzip is accepted
+	for _, compress := range []bool{true, false} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !compress {
+				w.Write(body)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed.Bytes())
+		}))
+
+		bs, err := newHttpClient(5 * time.Second).get(server.URL + "/v2-beta/projects")
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, _ := jsonparser.GetString(bs, "data", "[0]", "name"); name != "Default" {
+			t.Errorf("the projects compressed %v decode to the name %q, want Default", compress, name)
+		}
+	}
+}
+
+func TestServiceFetchDurationSkippedUnderFlat(t *testing.T) {
+	serviceFetches := func() uint64 {
+		pb := &dto.Metric{}
+		exporterServiceFetchDuration.WithLabelValues("false").Write(pb)
+		return pb.GetHistogram().GetSampleCount()
+	}
+
+	for _, c := range []struct {
+		engine  string
+		fetches uint64
+	}{
+		{"nested", 1},
+		{"flat", 0},
+	} {
+		setUpFlags()
+		fetchEngine = c.engine
+		r := newTestExporter(newFakeAPI(fakeEnvironment()))
+
+		before := serviceFetches()
+		scrape(r)
+		if fetches := serviceFetches() - before; fetches != c.fetches {
+			t.Errorf("the %s engine observes %d service fetches, want %d", c.engine, fetches, c.fetches)
+		}
+	}
+}
+
+func TestValidateScrapeTimeout(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		scrapeTimeout time.Duration
+		pushInterval  time.Duration
+		valid         bool
+	}{
+		{"below the interval", 5 * time.Second, 15 * time.Second, true},
+		{"zero timeout", 0, 15 * time.Second, false},
+		{"negative timeout", -time.Second, 15 * time.Second, false},
+		{"zero interval", 5 * time.Second, 0, false},
+		{"negative interval", 5 * time.Second, -15 * time.Second, false},
+		{"interval equal to the timeout", 15 * time.Second, 15 * time.Second, false},
+		{"interval below the timeout", 20 * time.Second, 15 * time.Second, false},
+	} {
+		if err := validateScrapeTimeout(c.scrapeTimeout, c.pushInterval); (err == nil) != c.valid {
+			t.Errorf("%s is valid %v, want %v: %v", c.name, err == nil, c.valid, err)
+		}
+	}
+}
+
+func TestPushAfterFetch(t *testing.T) {
+	setUpFlags()
+	pushes := make(chan []*dto.MetricFamily, 1)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var families []*dto.MetricFamily
+		decoder := expfmt.NewDecoder(req.Body, expfmt.ResponseFormat(req.Header))
+		for {
+			family := &dto.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				break
+			}
+			families = append(families, family)
+		}
+		pushes <- families
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+	defer func(address string) { pushgatewayURL = address }(pushgatewayURL)
+	pushgatewayURL, pushInterval = gateway.URL, time.Hour
+
+	api := newFakeAPI(fakeEnvironment())
+	r := newTestExporter(api)
+	lastFetch := prometheus.NewRegistry()
+	lastFetch.MustRegister(newLastFetchExporter(r))
+	stopChan := make(chan interface{})
+	defer close(stopChan)
+	go pushMetrics(r, lastFetch, stopChan)
+
+	server := newTestServer(r)
+	defer server.Close()
+	resp, err := http.Get(server.URL + metricPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case families := <-pushes:
+		scaled := false
+		for _, family := range families {
+			scaled = scaled || family.GetName() == "rancher_service_scale"
+		}
+		if !scaled {
+			t.Error("the push misses the services of the fetch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fetch of the scrape is not pushed")
+	}
+	if fetches := api.requested(cattleURL + "/projects"); fetches != 1 {
+		t.Errorf("the scrape and its push fetch %d times, want 1", fetches)
+	}
+}
+
+func TestMetricsPath(t *testing.T) {
+	setUpFlags()
+	metricPath = "/rancher/metrics"
+	server := newTestServer(newTestExporter(newFakeAPI(fakeEnvironment())))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + metricPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s answers %d, want 200", metricPath, resp.StatusCode)
+	}
+	if !strings.Contains(string(body), `rancher_stacks_total{environment_name="Default"} 1`) {
+		t.Errorf("%s misses the stacks of the environment:\n%s", metricPath, body)
+	}
+
+	resp, err = http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "href='"+metricPath+"'") {
+		t.Errorf("the landing page does not link %s:\n%s", metricPath, body)
+	}
+}
+
+func TestServerErrorsBubbleUp(t *testing.T) {
+	setUpFlags()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "rancher is down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	cattleURL = server.URL + "/v2-beta"
+
+	api := newHttpClient(5 * time.Second)
+	if _, err := api.get(cattleURL + "/projects/1a5/hosts"); err == nil {
+		t.Fatal("a 500 answer is not an error")
+	} else if statusErr, ok := err.(*statusError); !ok || statusErr.statusCode != http.StatusInternalServerError {
+		t.Fatalf("a 500 answer fails with %v, want its status", err)
+	}
+
+	labels := prometheus.Labels{"environment_name": "Default", "endpoint": "hosts"}
+	before, _ := seriesValue(exporterScrapeErrors, labels)
+	scrape(newTestExporter(api))
+
+	if after, _ := seriesValue(exporterScrapeErrors, labels); after-before != 1 {
+		t.Errorf("%v failed hosts listings are counted, want 1", after-before)
+	}
+	if success, _ := seriesValue(exporterScrapeSuccess, nil); success != 0 {
+		t.Errorf("the scrape is successful")
+	}
+}
+
+func TestUnreachableRancher(t *testing.T) {
+	setUpFlags()
+	server := httptest.NewServer(http.NotFoundHandler())
+	address := server.URL + "/v2-beta/projects"
+	server.Close()
+
+	bs, err := newHttpClient(5 * time.Second).get(address)
+	if err == nil {
+		t.Fatal("a closed server answers")
+	}
+	if bs != nil {
+		t.Errorf("a closed server answers %q", bs)
+	}
+	if !connectionFailed(err) {
+		t.Errorf("a closed server fails with %v, want a refused connection", err)
+	}
+}
+
+func TestScrapeErrorsByEndpoint(t *testing.T) {
+	setUpFlags()
+	responses := fakeEnvironment()
+	delete(responses, cattleURL+"/projects/1a5/hosts")
+	r := newTestExporter(newFakeAPI(responses))
+
+	scrapeErrors := func(endpoint string) float64 {
+		value, _ := seriesValue(exporterScrapeErrors, prometheus.Labels{"environment_name": "Default", "endpoint": endpoint})
+		return value
+	}
+	hostsBefore, servicesBefore := scrapeErrors("hosts"), scrapeErrors("services")
+	scrape(r)
+
+	if moved := scrapeErrors("hosts") - hostsBefore; moved != 1 {
+		t.Errorf("%v failed hosts listings are counted, want 1", moved)
+	}
+	if moved := scrapeErrors("services") - servicesBefore; moved != 0 {
+		t.Errorf("%v failed services listings are counted, want 0", moved)
+	}
+	if services, _ := seriesValue(extendingServicesTotal, prometheus.Labels{"environment_name": "Default"}); services != 1 {
+		t.Error("the services are not fetched along the failing hosts")
+	}
+}
+
+func TestRegisteringService(t *testing.T) {
+	setUpFlags()
+	responses := fakeEnvironment()
+	responses[cattleURL+"/stacks/1st1/services?limit=100&sort=id"] = collection(`{"id":"1s1","name":"nginx","state":"registering","healthState":"unhealthy","system":false,"type":"service","scale":1}`)
+	responses[cattleURL+"/services/1s1/instances?limit=100&sort=id"] = collection()
+	serviceStatus = true
+	r := newTestExporter(newFakeAPI(responses))
+
+	scrape(r)
+
+	labels := prometheus.Labels{"environment_name": "Default", "stack_name": "web", "name": "nginx"}
+	for _, expected := range []struct {
+		name      string
+		collector prometheus.Collector
+		value     float64
+	}{
+		{"rancher_service_registering", extendingServiceRegistering, 1},
+		{"rancher_service_down", extendingServiceDown, 0},
+		{"rancher_service_status", extendingServiceStatus, 1},
+	} {
+		if value, ok := seriesValue(expected.collector, labels); !ok || value != expected.value {
+			t.Errorf("%s of a registering service is %v, want %v", expected.name, value, expected.value)
+		}
+	}
+}
+
+func TestInstanceMetricsSystem(t *testing.T) {
+	for _, instanceMetrics := range []bool{false, true} {
+		setUpFlags()
+		instanceMetricsSystem = instanceMetrics
+		responses := fakeEnvironment()
+		responses[cattleURL+"/services/1s1/instances?limit=100&sort=id"] = collection(
+			`{"id":"1i1","name":"web-nginx-1","state":"running","system":false,"type":"container","createdTS":1000,"firstRunningTS":3000,"startCount":1}`,
+			`{"id":"1i2","name":"network-agent","state":"running","system":true,"type":"container","createdTS":1000,"firstRunningTS":3000,"startCount":1}`)
+		r := newTestExporter(newFakeAPI(responses))
+
+		scrape(r)
+
+		if _, ok := seriesValue(extendingInstanceRestartCount, prometheus.Labels{"name": "web-nginx-1"}); !ok {
+			t.Errorf("the user instance has no restart gauge with instance_metrics_system %v", instanceMetrics)
+		}
+		if _, ok := seriesValue(extendingInstanceRestartCount, prometheus.Labels{"name": "network-agent"}); ok != instanceMetrics {
+			t.Errorf("the system instance has a restart gauge %v with instance_metrics_system %v", ok, instanceMetrics)
+		}
+		if instances, _ := seriesValue(extendingInstancesTotal, prometheus.Labels{"environment_name": "Default"}); instances != 2 {
+			t.Errorf("%v instances are counted with instance_metrics_system %v, want 2", instances, instanceMetrics)
+		}
+	}
+}
+
+func TestMetricsCompression(t *testing.T) {
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, c := range []struct {
+		disableCompression bool
+		acceptEncoding     string
+		contentEncoding    string
+	}{
+		{false, "gzip", "gzip"},
+		{false, "", ""},
+		{true, "gzip", ""},
+	} {
+		setUpFlags()
+		disableCompression = c.disableCompression
+		server := newTestServer(newTestExporter(newFakeAPI(fakeEnvironment())))
+
+		req, _ := http.NewRequest("GET", server.URL+metricPath, nil)
+		if c.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+
+		if contentEncoding := resp.Header.Get("Content-Encoding"); contentEncoding != c.contentEncoding {
+			t.Errorf("accepting %q with disable_compression %v is answered with %q, want %q", c.acceptEncoding, c.disableCompression, contentEncoding, c.contentEncoding)
+		}
+	}
+}
+
+func TestBootstrapRunningBeforeCreation(t *testing.T) {
+	setUpFlags()
+	responses := fakeEnvironment()
+	responses[cattleURL+"/services/1s1/instances?limit=100&sort=id"] = collection(
+		`{"id":"1i1","name":"web-nginx-1","state":"running","system":false,"type":"container","createdTS":1000,"firstRunningTS":3000,"startCount":1}`,
+		`{"id":"1i2","name":"skewed-nginx","state":"running","system":false,"type":"container","createdTS":10,"firstRunningTS":5,"startCount":1}`)
+	r := newTestExporter(newFakeAPI(responses))
+
+	scrape(r)
+
+	if value, ok := seriesValue(extendingInstanceBootstrapMsCost, prometheus.Labels{"name": "web-nginx-1"}); !ok || value != 2000 {
+		t.Errorf("the bootstrap of web-nginx-1 is %v, want 2000", value)
+	}
+	if value, ok := seriesValue(extendingInstanceBootstrapMsCost, prometheus.Labels{"name": "skewed-nginx"}); ok {
+		t.Errorf("the bootstrap of skewed-nginx, running before its creation, is %v", value)
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorizations = append(authorizations, req.Header.Get("Authorization"))
+		w.Write([]byte(collection()))
+	}))
+	defer server.Close()
+	defer func() {
+		cattleAccessKey, cattleSecretKey, cattleToken = "", "", ""
+	}()
+
+	setUpFlags()
+	cattleAccessKey, cattleSecretKey = "access", "secret"
+	for _, token := range []string{"", "token"} {
+		cattleToken = token
+		if _, err := newHttpClient(5 * time.Second).get(server.URL + "/v2-beta/projects"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(authorizations) != 2 {
+		t.Fatalf("%d requests reach the server, want 2", len(authorizations))
+	}
+	if user, password, ok := (&http.Request{Header: http.Header{"Authorization": {authorizations[0]}}}).BasicAuth(); !ok || user != "access" || password != "secret" {
+		t.Errorf("the keys are sent as %q, want the basic auth of access:secret", authorizations[0])
+	}
+	if authorizations[1] != "Bearer token" {
+		t.Errorf("the token is sent as %q, want Bearer token", authorizations[1])
+	}
+}
+
+func TestEnvironmentCredentials(t *testing.T) {
+	setUpFlags()
+	authorizations := make(map[string]string)
+	mutex := &sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		authorizations[req.URL.Path] = req.Header.Get("Authorization")
+		mutex.Unlock()
+		w.Write([]byte(collection()))
+	}))
+	defer server.Close()
+	defer func() {
+		cattleToken = ""
+	}()
+
+	cattleToken = "token"
+	environmentCredentials = map[string]string{"1a7": "scoped:secret"}
+	api := newHttpClient(5 * time.Second)
+	for _, projectId := range []string{"1a5", "1a7"} {
+		if _, err := api.withEnvironment(projectId).withContext(context.Background()).get(server.URL + "/v2-beta/projects/" + projectId + "/stacks"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if authorization := authorizations["/v2-beta/projects/1a5/stacks"]; authorization != "Bearer token" {
+		t.Errorf("the environment without keys of its own is sent %q, want Bearer token", authorization)
+	}
+	scoped := &http.Request{Header: http.Header{"Authorization": {authorizations["/v2-beta/projects/1a7/stacks"]}}}
+	if user, password, ok := scoped.BasicAuth(); !ok || user != "scoped" || password != "secret" {
+		t.Errorf("the environment with keys of its own is sent %q, want the basic auth of scoped:secret", scoped.Header.Get("Authorization"))
+	}
+
+	projects := collection(`{"id":"1a5","name":"Default"}`, `{"id":"1a7","name":"Production"}`)
+	if err := checkEnvironmentCredentials([]byte(projects)); err != nil {
+		t.Errorf("the credentials of a listed environment fail with %v", err)
+	}
+	environmentCredentials["1a9"] = "gone:secret"
+	if err := checkEnvironmentCredentials([]byte(projects)); err == nil {
+		t.Error("the credentials of an unknown environment pass")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(collection()))
+	}))
+	defer server.Close()
+	defer func() {
+		rancherTransport = nil
+	}()
+
+	caCertFile, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caCertFile.Name())
+	pem.Encode(caCertFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caCertFile.Close()
+
+	setUpFlags()
+	for _, c := range []struct {
+		name       string
+		insecure   bool
+		caCertFile string
+		reachable  bool
+	}{
+		{"the system CA certificates", false, "", false},
+		{"no verification", true, "", true},
+		{"the CA certificate file", false, caCertFile.Name(), true},
+	} {
+		tlsConfig, err := newTLSConfig(c.insecure, c.caCertFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rancherTransport = newRancherTransport(tlsConfig)
+
+		if _, err := newHttpClient(5 * time.Second).get(server.URL + "/v2-beta/projects"); (err == nil) != c.reachable {
+			t.Errorf("the self-signed server is reachable %v with %s, want %v: %v", err == nil, c.name, c.reachable, err)
+		}
+	}
+
+	if _, err := newTLSConfig(false, caCertFile.Name()+".missing"); err == nil {
+		t.Error("a missing CA certificate file is accepted")
+	}
+	if _, err := newTLSConfig(false, os.Args[0]); err == nil {
+		t.Error("a CA certificate file without PEM certificates is accepted")
+	}
+}
+
+func TestScrapeDuration(t *testing.T) {
+	setUpFlags()
+	api := newFakeAPI(fakeEnvironment())
+	api.delay = 10 * time.Millisecond
+	r := newTestExporter(api)
+
+	observed := func() (uint64, float64) {
+		pb := &dto.Metric{}
+		exporterScrapeDuration.Write(pb)
+		return pb.GetHistogram().GetSampleCount(), pb.GetHistogram().GetSampleSum()
+	}
+	countBefore, sumBefore := observed()
+	scrape(r)
+	count, sum := observed()
+
+	if count-countBefore != 1 {
+		t.Errorf("%d scrape durations are observed, want 1", count-countBefore)
+	}
+	if sum-sumBefore < api.delay.Seconds() {
+		t.Errorf("the scrape took %vs, want at least the %v of a request", sum-sumBefore, api.delay)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(version.NewCollector("rancher_exporter"))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != "rancher_exporter_build_info" {
+			continue
+		}
+
+		metric := family.GetMetric()[0]
+		if metric.GetGauge().GetValue() != 1 {
+			t.Errorf("rancher_exporter_build_info is %v, want 1", metric.GetGauge().GetValue())
+		}
+		labels := make(map[string]string)
+		for _, labelPair := range metric.GetLabel() {
+			labels[labelPair.GetName()] = labelPair.GetValue()
+		}
+		for _, name := range []string{"version", "revision", "branch", "goversion"} {
+			if _, ok := labels[name]; !ok {
+				t.Errorf("rancher_exporter_build_info has no %s label: %v", name, labels)
+			}
+		}
+		return
+	}
+	t.Error("rancher_exporter_build_info is not collected")
+}
+
+func TestPaginationStopsOnceCancelled(t *testing.T) {
+	setUpFlags()
+	address := cattleURL + "/projects/1a5/hosts"
+	api := newFakeAPI(map[string]string{})
+	for page := 1; page <= 3; page++ {
+		api.set(fmt.Sprintf("%s?page=%d", address, page), fmt.Sprintf(`{"type":"collection","data":[{"id":"1h%d"}],"pagination":{"next":"%s?page=%d"}}`, page, address, page+1))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSyncScrape(api, ctx, newRancherProject("1a5", "Default", newFakeEvents()))
+
+	var hosts []string
+	s.eachData("hosts", address+"?page=1", func(hostBytes []byte) {
+		hostId, _ := jsonparser.GetString(hostBytes, "id")
+		hosts = append(hosts, hostId)
+
+		// the scrape times out while the first page is handled
+		cancel()
+	})
+
+	if len(hosts) != 1 || hosts[0] != "1h1" {
+		t.Errorf("the hosts %v are listed, want the ones of the first page", hosts)
+	}
+	if requested := api.requested(address + "?page=2"); requested != 0 {
+		t.Errorf("the second page is requested %d times after the cancellation", requested)
+	}
+	if s.errs.empty() {
+		t.Error("the cancelled listing is not counted as a fetch error")
+	}
+}
+
+func TestNon2xxResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2-beta/projects":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"error","status":401,"code":"Unauthorized","message":"Unauthorized"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"type":"error","status":404,"code":"NotFound","message":"` + strings.Repeat("x", 300) + `"}`))
+		}
+	}))
+	defer server.Close()
+
+	setUpFlags()
+	for _, c := range []struct {
+		path       string
+		statusCode int
+		message    string
+	}{
+		{"/v2-beta/projects", http.StatusUnauthorized, `unexpected status 401 Unauthorized, {"type":"error","status":401,"code":"Unauthorized"`},
+		{"/v2-beta/projects/1a5/stacks/1st404", http.StatusNotFound, `unexpected status 404 Not Found, {"type":"error","status":404,"code":"NotFound"`},
+	} {
+		bs, err := newHttpClient(5 * time.Second).get(server.URL + c.path)
+		if bs != nil {
+			t.Errorf("%s hands back the body %q of its error", c.path, bs)
+		}
+		statusErr, ok := err.(*statusError)
+		if !ok || statusErr.statusCode != c.statusCode {
+			t.Errorf("%s fails with %v, want the status %d", c.path, err, c.statusCode)
+			continue
+		}
+		if message := statusErr.Error(); !strings.HasPrefix(message, c.message) || len(message) > 300 {
+			t.Errorf("%s fails with the message %q, want a snippet starting with %q", c.path, message, c.message)
+		}
+	}
+}
+
+func TestHostCapacity(t *testing.T) {
+	setUpFlags()
+	responses := fakeEnvironment()
+	responses[cattleURL+"/projects/1a5/hosts"] = collection(
+		`{"id":"1h1","name":"node-1","state":"active","agentState":"active","info":{"cpuInfo":{"count":4,"modelName":"Intel(R) Xeon(R)","mhz":2400},"memoryInfo":{"memTotal":7976,"memFree":1024,"memAvailable":4096}}}`,
+		`{"id":"1h2","name":"node-2","state":"active","agentState":"active"}`)
+	r := newTestExporter(newFakeAPI(responses))
+
+	scrape(r)
+
+	node1 := prometheus.Labels{"id": "1h1", "name": "node-1"}
+	if cores, ok := seriesValue(extendingHostCPUCores, node1); !ok || cores != 4 {
+		t.Errorf("node-1 has %v CPU cores, want 4", cores)
+	}
+	if memory, ok := seriesValue(extendingHostMemoryBytes, node1); !ok || memory != 7976*1024*1024 {
+		t.Errorf("node-1 has %v memory bytes, want %v", memory, 7976*1024*1024)
+	}
+
+	// a host whose agent has not reported its info yet has no capacity rather than a zero one
+	node2 := prometheus.Labels{"id": "1h2", "name": "node-2"}
+	if _, ok := seriesValue(extendingHostCPUCores, node2); ok {
+		t.Error("node-2 has CPU cores without any info")
+	}
+	if _, ok := seriesValue(extendingHostMemoryBytes, node2); ok {
+		t.Error("node-2 has memory bytes without any info")
+	}
+}
+
+func TestHostLabelKeys(t *testing.T) {
+	setUpFlags()
+	hostLabelKeys = []string{"region", "io.rancher.host.os"}
+	extendingHostLabels = newHostLabelsVec(hostLabelKeys)
+	defer func() {
+		hostLabelKeys = nil
+		extendingHostLabels = newHostLabelsVec(nil)
+	}()
+	responses := fakeEnvironment()
+	responses[cattleURL+"/projects/1a5/hosts"] = collection(`{"id":"1h1","name":"node-1","state":"active","agentState":"active","labels":{"region":"eu-west","rack":"r12","io.rancher.host.os":"linux"}}`)
+	r := newTestExporter(newFakeAPI(responses))
+
+	scrape(r)
+
+	metrics := gatherMetrics(extendingHostLabels)
+	if len(metrics) != 1 {
+		t.Fatalf("%d host labels series are collected, want 1", len(metrics))
+	}
+	pb := &dto.Metric{}
+	metrics[0].Write(pb)
+	labels := make(map[string]string)
+	for _, labelPair := range pb.GetLabel() {
+		labels[labelPair.GetName()] = labelPair.GetValue()
+	}
+
+	expected := map[string]string{"id": "1h1", "name": "node-1", "label_region": "eu-west", "label_io_rancher_host_os": "linux"}
+	if len(labels) != len(expected) {
+		t.Errorf("the host labels are %v, want only the allow-listed %v", labels, expected)
+	}
+	for name, value := range expected {
+		if labels[name] != value {
+			t.Errorf("the host label %s is %q, want %q", name, labels[name], value)
+		}
+	}
+	if pb.GetGauge().GetValue() != 1 {
+		t.Errorf("rancher_host_labels is %v, want 1", pb.GetGauge().GetValue())
+	}
+}
+
+func TestServiceInstancesRunning(t *testing.T) {
+	setUpFlags()
+	responses := fakeEnvironment()
+	responses[cattleURL+"/stacks/1st1/services?limit=100&sort=id"] = collection(`{"id":"1s1","name":"nginx","state":"active","healthState":"degraded","system":false,"type":"service","scale":4}`)
+	responses[cattleURL+"/services/1s1/instances?limit=100&sort=id"] = collection(
+		`{"id":"1i1","name":"web-nginx-1","state":"running","system":false,"type":"container","createdTS":1000,"firstRunningTS":3000,"startCount":1}`,
+		`{"id":"1i2","name":"web-nginx-2","state":"running","system":false,"type":"container","createdTS":1000,"firstRunningTS":3000,"startCount":1}`,
+		`{"id":"1i3","name":"web-nginx-3","state":"stopped","system":false,"type":"container","createdTS":1000,"firstRunningTS":3000,"startCount":1}`,
+		`{"id":"1i4","name":"web-nginx-4","state":"starting","system":false,"type":"container","createdTS":1000,"startCount":0}`)
+	r := newTestExporter(newFakeAPI(responses))
+
+	scrape(r)
+
+	labels := prometheus.Labels{"name": "nginx", "stack_name": "web", "system": "false"}
+	if running, ok := seriesValue(extendingServiceInstancesRunning, labels); !ok || running != 2 {
+		t.Errorf("nginx has %v running instances, want 2", running)
+	}
+	if scale, ok := seriesValue(infinityWorksServicesScale, labels); !ok || scale != 4 {
+		t.Errorf("the scale of nginx is %v, want 4", scale)
+	}
+}
+
+func TestInstanceRestartCount(t *testing.T) {
+	setUpFlags()
+	instances := cattleURL + "/services/1s1/instances?limit=100&sort=id"
+	api := newFakeAPI(fakeEnvironment())
+	r := newTestExporter(api)
+	labels := prometheus.Labels{"environment_name": "Default", "stack_name": "web", "service_name": "nginx", "name": "web-nginx-1"}
+
+	for _, c := range []struct {
+		startCount int
+		restarts   float64
+	}{
+		{1, 0},
+		{4, 3},
+		// a container not started yet has no restart either
+		{0, 0},
+	} {
+		api.set(instances, collection(fmt.Sprintf(`{"id":"1i1","name":"web-nginx-1","state":"running","system":false,"type":"container","createdTS":1000,"firstRunningTS":3000,"startCount":%d}`, c.startCount)))
+		scrape(r)
+
+		if restarts, ok := seriesValue(extendingInstanceRestartCount, labels); !ok || restarts != c.restarts {
+			t.Errorf("web-nginx-1 started %d times has %v restarts, want %v", c.startCount, restarts, c.restarts)
+		}
+	}
+}
+
+func TestMetadataExporter(t *testing.T) {
+	setUpFlags()
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/latest/services":
+			w.Write([]byte(`[{"name":"nginx","stack_name":"web","kind":"service","scale":2,"system":false},{"name":"redis","stack_name":"web","kind":"service","scale":1,"system":false}]`))
+		case "/latest/containers":
+			w.Write([]byte(`[{"name":"web-nginx-1","stack_name":"web","service_name":"nginx","state":"running","health_state":"healthy"}]`))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer metadata.Close()
+
+	r := newTestExporter(newFakeAPI(fakeEnvironment()))
+	scrape(r)
+	m := newMetadataExporter(metadata.URL+"/latest/", r)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+
+	nginx := prometheus.Labels{"name": "nginx", "stack_name": "web", "system": "false"}
+	if value, ok := seriesValue(metadataServicesScale, prometheus.Labels{"name": "nginx", "stack_name": "web", "system": "false", "type": "service"}); !ok || value != 2 {
+		t.Errorf("the metadata scale of nginx is %v, want 2", value)
+	}
+	if value, ok := seriesValue(metadataServicesContainers, prometheus.Labels{"name": "nginx", "stack_name": "web", "state": "running"}); !ok || value != 1 {
+		t.Errorf("the metadata containers of nginx are %v, want 1", value)
+	}
+
+	// the API scales nginx to 1 and does not know redis
+	if value, ok := seriesValue(metadataServicesScaleMismatch, nginx); !ok || value != 1 {
+		t.Errorf("the scale mismatch of nginx is %v, want 1", value)
+	}
+	if _, ok := seriesValue(metadataServicesScaleMismatch, prometheus.Labels{"name": "redis"}); ok {
+		t.Error("the scale of redis is cross-checked while the API does not know it")
+	}
+
+	if _, err := m.get("/self"); err == nil {
+		t.Error("a 404 from the metadata service is not an error")
+	} else if statusErr, ok := err.(*statusError); !ok || statusErr.statusCode != http.StatusNotFound {
+		t.Errorf("a 404 from the metadata service fails with %v, want its status", err)
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	setUpFlags()
+	api := newFakeAPI(fakeEnvironment())
+	r := newTestExporter(api)
+	server := newTestServer(r)
+	defer server.Close()
+
+	statusOf := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := statusOf("/healthz"); status != http.StatusOK {
+		t.Errorf("/healthz answers %d before the first fetch, want 200", status)
+	}
+	if status := statusOf("/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz answers %d before the first fetch, want 503", status)
+	}
+	if requested := api.requested(cattleURL + "/projects/1a5/hosts"); requested != 0 {
+		t.Errorf("the health checks fetch from Rancher %d times", requested)
+	}
+
+	scrape(r)
+
+	if status := statusOf("/readyz"); status != http.StatusOK {
+		t.Errorf("/readyz answers %d after a successful fetch, want 200", status)
+	}
+}
+
+func TestStackFilters(t *testing.T) {
+	stackNames := []string{"web-frontend", "web-backend", "web-canary", "db"}
+
+	for _, c := range []struct {
+		include, exclude string
+		selected         []string
+	}{
+		{"", "", []string{"web-frontend", "web-backend", "web-canary", "db"}},
+		{"^web-", "", []string{"web-frontend", "web-backend", "web-canary"}},
+		{"", "canary", []string{"web-frontend", "web-backend", "db"}},
+		{"^web-", "canary|backend", []string{"web-frontend"}},
+		{"^db$", "^db$", nil},
+	} {
+		setUpFlags()
+		if c.include != "" {
+			stackInclude = regexp.MustCompile(c.include)
+		}
+		if c.exclude != "" {
+			stackExclude = regexp.MustCompile(c.exclude)
+		}
+
+		responses := fakeEnvironment()
+		var stackItems []string
+		for i, stackName := range stackNames {
+			stackItems = append(stackItems, fmt.Sprintf(`{"id":"1st%d","name":%q,"state":"active","healthState":"healthy","system":false,"type":"stack"}`, i, stackName))
+			responses[fmt.Sprintf("%s/stacks/1st%d/services?limit=100&sort=id", cattleURL, i)] = collection()
+		}
+		responses[cattleURL+"/projects/1a5/stacks?limit=100&sort=id"] = collection(stackItems...)
+		api := newFakeAPI(responses)
+		r := newTestExporter(api)
+
+		scrape(r)
+
+		selected := make(map[string]bool)
+		for _, stackName := range c.selected {
+			selected[stackName] = true
+		}
+		for i, stackName := range stackNames {
+			_, emitted := seriesValue(infinityWorksStacksHealth, prometheus.Labels{"name": stackName})
+			listed := api.requested(fmt.Sprintf("%s/stacks/1st%d/services?limit=100&sort=id", cattleURL, i)) != 0
+			if emitted != selected[stackName] || listed != selected[stackName] {
+				t.Errorf("with the include %q and the exclude %q, %s is emitted %v and has its services listed %v, want %v",
+					c.include, c.exclude, stackName, emitted, listed, selected[stackName])
+			}
+		}
+	}
+}
+
+func TestAPIRequestDuration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(collection()))
+	}))
+	defer server.Close()
+
+	observed := func(resource string) (uint64, float64) {
+		pb := &dto.Metric{}
+		exporterAPIRequestDuration.WithLabelValues(resource).(prometheus.Histogram).Write(pb)
+		return pb.GetHistogram().GetSampleCount(), pb.GetHistogram().GetSampleSum()
+	}
+
+	setUpFlags()
+	countBefore, sumBefore := observed("instances")
+	if _, err := newHttpClient(5 * time.Second).get(server.URL + "/v2-beta/services/1s1/instances?limit=100&sort=id"); err != nil {
+		t.Fatal(err)
+	}
+	count, sum := observed("instances")
+
+	if count-countBefore != 1 {
+		t.Errorf("%d instances requests are observed, want 1", count-countBefore)
+	}
+	if sum-sumBefore < 0.01 {
+		t.Errorf("the instances request took %vs, want at least 10ms", sum-sumBefore)
+	}
+}
+
+func TestAPIResource(t *testing.T) {
+	for address, resource := range map[string]string{
+		"http://rancher/v2-beta/projects":                                 "projects",
+		"http://rancher/v2-beta/projects/1a5/hosts":                       "hosts",
+		"http://rancher/v2-beta/projects/1a5/stacks/1st1":                 "stacks",
+		"http://rancher/v2-beta/stacks/1st1/services?limit=100&sort=id":   "services",
+		"http://rancher/v2-beta/services/1s1/instances?limit=100&sort=id": "instances",
+		"http://rancher/v2-beta/projects/1a5/projectmembers?limit=100":    "projectmembers",
+		"http://rancher/v2-beta/genericobjects":                           "other",
+		"http://rancher/v2-beta":                                          "other",
+	} {
+		if actual := apiResource(address); actual != resource {
+			t.Errorf("the resource of %s is %s, want %s", address, actual, resource)
+		}
+	}
+}
+
+func TestAPIRequestsByStatusClass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/1st404") {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(collection()))
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	setUpFlags()
+	for _, c := range []struct {
+		name     string
+		address  string
+		resource string
+		code     string
+	}{
+		{"a success", server.URL + "/v2-beta/projects/1a5/hosts", "hosts", "2xx"},
+		{"a missing stack", server.URL + "/v2-beta/projects/1a5/stacks/1st404", "stacks", "4xx"},
+		{"a refused connection", closed.URL + "/v2-beta/projects", "projects", "error"},
+	} {
+		labels := prometheus.Labels{"resource": c.resource, "code": c.code}
+		before, _ := seriesValue(exporterAPIRequests, labels)
+		newHttpClient(5 * time.Second).get(c.address)
+
+		if after, _ := seriesValue(exporterAPIRequests, labels); after-before != 1 {
+			t.Errorf("%s is counted %v times as %s %s, want once", c.name, after-before, c.resource, c.code)
+		}
+	}
+}
+
+func TestPaginationTerminates(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+
+		next := "http://" + req.Host + req.URL.Path
+		if req.URL.Path == "/v2-beta/projects/1a5/stacks" {
+			// an endless listing, every page links to a new one
+			page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+			next = fmt.Sprintf("%s?page=%d", next, page+1)
+		}
+		fmt.Fprintf(w, `{"type":"collection","data":[{"id":"1h1"}],"pagination":{"next":%q}}`, next)
+	}))
+	defer server.Close()
+
+	setUpFlags()
+	maxPages = 5
+	defer func() {
+		maxPages = 0
+	}()
+	s := newSyncScrape(newHttpClient(5*time.Second), context.Background(), newRancherProject("1a5", "Default", newFakeEvents()))
+
+	for _, c := range []struct {
+		name    string
+		address string
+		pages   int
+	}{
+		{"a next link to itself", server.URL + "/v2-beta/projects/1a5/hosts", 1},
+		{"an endless listing", server.URL + "/v2-beta/projects/1a5/stacks", 5},
+	} {
+		mutex.Lock()
+		requests = 0
+		mutex.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			s.eachData("hosts", c.address, func(dataBytes []byte) {})
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the paging of %s does not terminate", c.name)
+		}
+
+		mutex.Lock()
+		if requests != c.pages {
+			t.Errorf("%d pages of %s are requested, want %d", requests, c.name, c.pages)
+		}
+		mutex.Unlock()
+	}
+	if s.errs.empty() {
+		t.Error("the stopped listings are not counted as fetch errors")
+	}
+}
+
+func TestDebugStackRoute(t *testing.T) {
+	setUpFlags()
+	debugEndpoints = true
+	debugAuthToken = "token"
+	defer func() {
+		debugAuthToken = ""
+	}()
+	responses := fakeEnvironment()
+	responses[cattleURL+"/projects/1a5/stacks/1st2"] = `{"id":"1st2","name":"healthcheck","state":"active","healthState":"healthy","system":true,"type":"stack"}`
+	responses[cattleURL+"/stacks/1st2/services?limit=100&sort=id"] = collection()
+	r := newTestExporter(newFakeAPI(responses))
+	server := newTestServer(r)
+	defer server.Close()
+
+	// the metrics of the scrapes are put back after the debug fetch
+	scrape(r)
+	infinityWorksServicesScale.WithLabelValues("scraped", "web", "false").Set(3)
+
+	for _, c := range []struct {
+		name          string
+		id            string
+		authorization string
+		hideSys       bool
+		statusCode    int
+	}{
+		{"no credentials", "1st1", "", false, http.StatusUnauthorized},
+		{"wrong token", "1st1", "Bearer wrong", false, http.StatusUnauthorized},
+		{"stack", "1st1", "Bearer token", false, http.StatusOK},
+		{"system stack", "1st2", "Bearer token", false, http.StatusOK},
+		{"hidden system stack", "1st2", "Bearer token", true, http.StatusNotFound},
+	} {
+		hideSys = c.hideSys
+		req, _ := http.NewRequest("GET", server.URL+"/debug/stack?id="+c.id, nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.statusCode {
+			t.Errorf("/debug/stack of the %s answers %d, want %d", c.name, resp.StatusCode, c.statusCode)
+		} else if c.id == "1st1" && c.statusCode == http.StatusOK {
+			if !strings.Contains(string(body), `"name":"rancher_service_scale","labels":{"name":"nginx"`) {
+				t.Errorf("/debug/stack misses the services of the stack:\n%s", body)
+			}
+			if !strings.Contains(string(body), `"name":"web-nginx-1"`) {
+				t.Errorf("/debug/stack misses the instances of the stack:\n%s", body)
+			}
+			if strings.Contains(string(body), "scraped") {
+				t.Errorf("/debug/stack answers the metrics of the scrapes:\n%s", body)
+			}
+		}
+	}
+	hideSys = false
+
+	if value, ok := seriesValue(infinityWorksServicesScale, prometheus.Labels{"name": "scraped"}); !ok || value != 3 {
+		t.Error("the metrics of the scrapes are not put back after the debug fetch")
+	}
+	if _, ok := seriesValue(infinityWorksServicesScale, prometheus.Labels{"name": "nginx"}); !ok {
+		t.Error("the scraped services are not put back after the debug fetch")
+	}
+}
+
+func TestFilteredFetch(t *testing.T) {
+	hosts := cattleURL + "/projects/1a5/hosts"
+	stacks := cattleURL + "/projects/1a5/stacks?limit=100&sort=id"
+	services := cattleURL + "/stacks/1st1/services?limit=100&sort=id"
+	instances := cattleURL + "/services/1s1/instances?limit=100&sort=id"
+
+	for _, c := range []struct {
+		collects  []string
+		requested []string
+		skipped   []string
+	}{
+		{[]string{"hosts"}, []string{hosts}, []string{stacks, services, instances}},
+		{[]string{"stacks"}, []string{stacks}, []string{hosts, services, instances}},
+		{[]string{"services"}, []string{stacks, services, instances}, []string{hosts}},
+	} {
+		setUpFlags()
+		api := newFakeAPI(fakeEnvironment())
+		r := newTestExporter(api)
+		fe, err := newFilteredExporter(r, c.collects)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ch := make(chan prometheus.Metric, 64)
+		go func() {
+			defer close(ch)
+
+			fe.Collect(ch)
+		}()
+		for range ch {
+		}
+
+		for _, address := range c.requested {
+			if api.requested(address) == 0 {
+				t.Errorf("collecting %v does not request %s", c.collects, address)
+			}
+		}
+		for _, address := range c.skipped {
+			if requested := api.requested(address); requested != 0 {
+				t.Errorf("collecting %v requests %s %d times", c.collects, address, requested)
+			}
+		}
+	}
+}
+
+func TestFilteredCollectLeavesSeriesCap(t *testing.T) {
+	setUpFlags()
+	maxTotalSeries = 1000
+	defer func() {
+		maxTotalSeries = 0
+	}()
+	r := newTestExporter(newFakeAPI(fakeEnvironment()))
+
+	collect := func(c prometheus.Collector) {
+		ch := make(chan prometheus.Metric, 64)
+		go func() {
+			defer close(ch)
+
+			c.Collect(ch)
+		}()
+		for range ch {
+		}
+	}
+
+	collect(r)
+	emitted := len(r.emittedSeries)
+	if emitted == 0 {
+		t.Fatal("the full collect lets no object series through")
+	}
+
+	fe, err := newFilteredExporter(r, []string{"hosts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect(fe)
+	if len(r.emittedSeries) != emitted {
+		t.Errorf("the filtered collect changes the series known to the cap from %d to %d", emitted, len(r.emittedSeries))
+	}
+}
+
+func TestSplitAPIBase(t *testing.T) {
+	for cattleURL, expected := range map[string][3]string{
+		"http://rancher:8080":                         {"http://rancher:8080", "", ""},
+		"http://rancher:8080/":                        {"http://rancher:8080", "", ""},
+		"http://rancher:8080/v1":                      {"http://rancher:8080", "v1", ""},
+		"http://rancher:8080/v2-beta/":                {"http://rancher:8080", "v2-beta", ""},
+		"http://rancher:8080/v2-beta/projects/1a5":    {"http://rancher:8080", "v2-beta", "/projects/1a5"},
+		"https://example.com/rancher/v1/projects/1a5": {"https://example.com/rancher", "v1", "/projects/1a5"},
+	} {
+		serverURL, apiBase, projectPath := splitAPIBase(cattleURL)
+		if actual := [3]string{serverURL, apiBase, projectPath}; actual != expected {
+			t.Errorf("%s splits into %q, want %q", cattleURL, actual, expected)
+		}
+	}
+}
+
+func TestDetectAPIBase(t *testing.T) {
+	setUpFlags()
+	for _, c := range []struct {
+		root    string
+		apiBase string
+	}{
+		{collection(`{"id":"v1","type":"apiVersion"}`, `{"id":"v2-beta","type":"apiVersion"}`), "v2-beta"},
+		{collection(`{"id":"v1","type":"apiVersion"}`), ""},
+		{collection(), ""},
+	} {
+		root := c.root
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(root))
+		}))
+
+		apiBase, err := detectAPIBase(server.URL)
+		server.Close()
+		if apiBase != c.apiBase || (err == nil) != (c.apiBase != "") {
+			t.Errorf("the root %s detects %q with %v, want %q", c.root, apiBase, err, c.apiBase)
+		}
+	}
+}
+
+func TestRancherUp(t *testing.T) {
+	setUpFlags()
+	api := newFakeAPI(fakeEnvironment())
+	r := newTestExporter(api)
+	labels := prometheus.Labels{"server": stripCredentials(cattleURL)}
+
+	scrape(r)
+	if up, ok := seriesValue(exporterRancherUp, labels); !ok || up != 1 {
+		t.Errorf("rancher_up is %v while the projects are listed, want 1", up)
+	}
+
+	api.mutex.Lock()
+	delete(api.responses, cattleURL+"/projects")
+	api.mutex.Unlock()
+	scrape(r)
+	if up, ok := seriesValue(exporterRancherUp, labels); !ok || up != 0 {
+		t.Errorf("rancher_up is %v while the projects fail, want 0", up)
+	}
+}
@@ -1,25 +1,89 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/prometheus/common/version"
 	"github.com/urfave/cli"
+	"golang.org/x/time/rate"
 )
 
 var (
-	listenAddress   string
-	metricPath      string
-	cattleURL       string
-	cattleAccessKey string
-	cattleSecretKey string
-	hideSys         bool
+	listenAddress          string
+	metricPath             string
+	cattleURL              string
+	cattleAccessKey        string
+	cattleSecretKey        string
+	cattleToken            string
+	tlsInsecure            bool
+	caCertFile             string
+	hideSys                bool
+	pushgatewayURL         string
+	pushJob                string
+	pushInterval           time.Duration
+	metadataURL            string
+	probeEndpoints         bool
+	probeTimeout           time.Duration
+	probeConcurrency       int
+	minScrapeInterval      time.Duration
+	scrapeTimeout          time.Duration
+	adaptiveInterval       bool
+	adaptiveIntervalMin    time.Duration
+	adaptiveIntervalMax    time.Duration
+	adaptiveIntervalFactor float64
+	filterRemovedInstances bool
+	serviceStatus          bool
+	strictScrape           bool
+	maxConcurrency         int
+	retryMax               int
+	retryBackoffMs         int
+	retryBackoff           time.Duration
+	maxStackConcurrency    int
+	maxPages               int
+	instanceSampleRate     float64
+	ownerLabelKey          string
+	instanceDataAge        bool
+	neverRunningGrace      time.Duration
+	rancherRPS             float64
+	rancherBurst           int
+	fetchEngine            string
+	maxLabelLength         int
+	debugEndpoints         bool
+	debugAuthUser          string
+	debugAuthPassword      string
+	debugAuthToken         string
+	startupEMAAlpha        float64
+	logResponseBodies      bool
+	maxLogBodyBytes        int
+	useBaseUnits           bool
+	stuckThresholdSeconds  int
+	serviceSelfLink        bool
+	collectLBBackends      bool
+	cattleAPIBase          string
+	collectMembers         bool
+	maxTotalSeries         int
+	instanceMetricsSystem  bool
+	disableCompression     bool
+	canonicalTypeLabels    bool
+	typeLabelOverrides     string
+	hostLabelSelectorFlag  string
+	hostLabelKeysFlag      string
+	stackIncludeFlag       string
+	stackExcludeFlag       string
+	environmentsFlag       string
+	environmentCredsFlag   string
 
 	log = logrus.New()
 )
@@ -48,7 +112,7 @@ func main() {
 		cli.StringFlag{
 			Name:        "metric_path",
 			Usage:       "The path of exposing metrics",
-			EnvVar:      "METRIC_PATH",
+			EnvVar:      "METRIC_PATH,METRICS_PATH",
 			Value:       "/metrics",
 			Destination: &metricPath,
 		},
@@ -58,6 +122,13 @@ func main() {
 			EnvVar:      "CATTLE_URL",
 			Destination: &cattleURL,
 		},
+		cli.StringFlag{
+			Name:        "cattle_api_base",
+			Usage:       "The API base of Rancher Server API, e.g. v2-beta, auto takes the one of cattle_url or detects it from the server root",
+			EnvVar:      "CATTLE_API_BASE",
+			Value:       "auto",
+			Destination: &cattleAPIBase,
+		},
 		cli.StringFlag{
 			Name:        "cattle_access_key",
 			Usage:       "The access key for Rancher API",
@@ -70,6 +141,24 @@ func main() {
 			EnvVar:      "CATTLE_SECRET_KEY",
 			Destination: &cattleSecretKey,
 		},
+		cli.StringFlag{
+			Name:        "cattle_token",
+			Usage:       "The bearer token for Rancher API, sent instead of the access and secret keys",
+			EnvVar:      "CATTLE_TOKEN",
+			Destination: &cattleToken,
+		},
+		cli.BoolFlag{
+			Name:        "tls_insecure",
+			Usage:       "Skip verifying the TLS certificate of Rancher API, e.g. a self-signed one",
+			EnvVar:      "TLS_INSECURE",
+			Destination: &tlsInsecure,
+		},
+		cli.StringFlag{
+			Name:        "ca_cert_file",
+			Usage:       "The PEM file of the CA certificates verifying the TLS certificate of Rancher API, instead of the system ones",
+			EnvVar:      "CA_CERT_FILE",
+			Destination: &caCertFile,
+		},
 		cli.StringFlag{
 			Name:   "log_level",
 			Usage:  "Set the logging level",
@@ -82,6 +171,335 @@ func main() {
 			EnvVar:      "HIDE_SYS",
 			Destination: &hideSys,
 		},
+		cli.StringFlag{
+			Name:        "pushgateway_url",
+			Usage:       "The URL of Prometheus Pushgateway to push the metrics to, e.g. http://127.0.0.1:9091",
+			EnvVar:      "PUSHGATEWAY_URL",
+			Destination: &pushgatewayURL,
+		},
+		cli.StringFlag{
+			Name:        "push_job",
+			Usage:       "The job name of pushing the metrics",
+			EnvVar:      "PUSH_JOB",
+			Value:       "rancher_exporter",
+			Destination: &pushJob,
+		},
+		cli.DurationFlag{
+			Name:        "push_interval",
+			Usage:       "The interval of pushing the metrics, which the scrape timeout must stay below",
+			EnvVar:      "PUSH_INTERVAL",
+			Value:       15 * time.Second,
+			Destination: &pushInterval,
+		},
+		cli.StringFlag{
+			Name:        "metadata_url",
+			Usage:       "The URL of Rancher Metadata Service to collect the metrics from additionally, e.g. http://rancher-metadata/latest",
+			EnvVar:      "METADATA_URL",
+			Destination: &metadataURL,
+		},
+		cli.BoolFlag{
+			Name:        "probe_endpoints",
+			Usage:       "Dial the public endpoints of the services over TCP to check the reachability",
+			EnvVar:      "PROBE_ENDPOINTS",
+			Destination: &probeEndpoints,
+		},
+		cli.DurationFlag{
+			Name:        "probe_timeout",
+			Usage:       "The timeout of dialing a public endpoint",
+			EnvVar:      "PROBE_TIMEOUT",
+			Value:       time.Second,
+			Destination: &probeTimeout,
+		},
+		cli.IntFlag{
+			Name:        "probe_concurrency",
+			Usage:       "The maximum number of the public endpoints dialing at the same time",
+			EnvVar:      "PROBE_CONCURRENCY",
+			Value:       8,
+			Destination: &probeConcurrency,
+		},
+		cli.DurationFlag{
+			Name:        "min_scrape_interval",
+			Usage:       "Serve the last fetched metrics instead of fetching from Rancher again within this interval",
+			EnvVar:      "MIN_SCRAPE_INTERVAL",
+			Destination: &minScrapeInterval,
+		},
+		cli.DurationFlag{
+			Name:        "scrape_timeout",
+			Usage:       "Abort the requests and the pagination of a fetch from Rancher running longer than this",
+			EnvVar:      "SCRAPE_TIMEOUT",
+			Value:       10 * time.Second,
+			Destination: &scrapeTimeout,
+		},
+		cli.BoolFlag{
+			Name:        "adaptive_interval",
+			Usage:       "Derive the minimum scrape interval from the measured fetch durations instead of min_scrape_interval",
+			EnvVar:      "ADAPTIVE_INTERVAL",
+			Destination: &adaptiveInterval,
+		},
+		cli.DurationFlag{
+			Name:        "adaptive_interval_min",
+			Usage:       "The floor of the adaptive scrape interval",
+			EnvVar:      "ADAPTIVE_INTERVAL_MIN",
+			Value:       10 * time.Second,
+			Destination: &adaptiveIntervalMin,
+		},
+		cli.DurationFlag{
+			Name:        "adaptive_interval_max",
+			Usage:       "The ceiling of the adaptive scrape interval",
+			EnvVar:      "ADAPTIVE_INTERVAL_MAX",
+			Value:       5 * time.Minute,
+			Destination: &adaptiveIntervalMax,
+		},
+		cli.Float64Flag{
+			Name:        "adaptive_interval_factor",
+			Usage:       "The multiple of the last fetch duration the adaptive scrape interval stays above",
+			EnvVar:      "ADAPTIVE_INTERVAL_FACTOR",
+			Value:       3,
+			Destination: &adaptiveIntervalFactor,
+		},
+		cli.BoolFlag{
+			Name:        "filter_removed_instances",
+			Usage:       "Ask Rancher to skip the removed and purged instances on listing",
+			EnvVar:      "FILTER_REMOVED_INSTANCES",
+			Destination: &filterRemovedInstances,
+		},
+		cli.BoolFlag{
+			Name:        "service_status",
+			Usage:       "Expose the combined status of every service",
+			EnvVar:      "SERVICE_STATUS",
+			Destination: &serviceStatus,
+		},
+		cli.BoolFlag{
+			Name:        "strict_scrape",
+			Usage:       "Keep serving the last complete states of hosts, stacks and services when a fetch fails partially",
+			EnvVar:      "STRICT_SCRAPE",
+			Destination: &strictScrape,
+		},
+		cli.IntFlag{
+			Name:        "rancher_max_concurrency",
+			Usage:       "The maximum number of the requests to Rancher API and of the fetch workers at the same time, 0 means unlimited",
+			EnvVar:      "RANCHER_MAX_CONCURRENCY,MAX_CONCURRENCY",
+			Value:       20,
+			Destination: &maxConcurrency,
+		},
+		cli.IntFlag{
+			Name:        "retry_max",
+			Usage:       "The maximum number of the retries of a request to Rancher API failing on timeouts, refused or reset connections, or 429 and 5xx responses, 0 means no retry",
+			EnvVar:      "RETRY_MAX",
+			Value:       2,
+			Destination: &retryMax,
+		},
+		cli.IntFlag{
+			Name:        "retry_backoff_ms",
+			Usage:       "The milliseconds of the backoff before the first retry, doubled on every retry after it and jittered",
+			EnvVar:      "RETRY_BACKOFF_MS",
+			Value:       200,
+			Destination: &retryBackoffMs,
+		},
+		cli.IntFlag{
+			Name:        "rancher_max_stack_concurrency",
+			Usage:       "The maximum number of the services of one stack fetching their instances at the same time, 0 means unlimited",
+			EnvVar:      "RANCHER_MAX_STACK_CONCURRENCY",
+			Value:       5,
+			Destination: &maxStackConcurrency,
+		},
+		cli.IntFlag{
+			Name:        "rancher_max_pages",
+			Usage:       "The maximum number of the pages followed in one Rancher API listing, 0 means unlimited",
+			EnvVar:      "RANCHER_MAX_PAGES",
+			Value:       1000,
+			Destination: &maxPages,
+		},
+		cli.Float64Flag{
+			Name:        "instance_sample_rate",
+			Usage:       "The fraction (0..1) of the instances emitting the per-instance metrics",
+			EnvVar:      "INSTANCE_SAMPLE_RATE",
+			Value:       1,
+			Destination: &instanceSampleRate,
+		},
+		cli.StringFlag{
+			Name:        "owner_label_key",
+			Usage:       "The service label key holding the owner, e.g. team, exposes the owner of every service when set",
+			EnvVar:      "OWNER_LABEL_KEY",
+			Destination: &ownerLabelKey,
+		},
+		cli.BoolFlag{
+			Name:        "instance_data_age",
+			Usage:       "Expose how long ago Rancher updated the data of every instance",
+			EnvVar:      "INSTANCE_DATA_AGE",
+			Destination: &instanceDataAge,
+		},
+		cli.DurationFlag{
+			Name:        "never_running_grace",
+			Usage:       "Flag the instances created longer than this ago which have never been running, 0 means not collected",
+			EnvVar:      "NEVER_RUNNING_GRACE",
+			Destination: &neverRunningGrace,
+		},
+		cli.Float64Flag{
+			Name:        "rancher_rps",
+			Usage:       "The maximum number of the requests to Rancher API per second, 0 means unlimited",
+			EnvVar:      "RANCHER_RPS",
+			Destination: &rancherRPS,
+		},
+		cli.IntFlag{
+			Name:        "rancher_burst",
+			Usage:       "The maximum number of the requests to Rancher API sent at once when rancher_rps is set",
+			EnvVar:      "RANCHER_BURST",
+			Value:       1,
+			Destination: &rancherBurst,
+		},
+		cli.StringFlag{
+			Name:        "fetch_engine",
+			Usage:       "How to fetch the stacks, services and instances [nested, flat], flat lists each kind once per environment",
+			EnvVar:      "FETCH_ENGINE",
+			Value:       "nested",
+			Destination: &fetchEngine,
+		},
+		cli.IntFlag{
+			Name:        "max_label_length",
+			Usage:       "The maximum length of the name and type label values, longer ones are truncated with a hash suffix, 0 means unlimited",
+			EnvVar:      "MAX_LABEL_LENGTH",
+			Destination: &maxLabelLength,
+		},
+		cli.BoolFlag{
+			Name:        "debug_endpoints",
+			Usage:       "Serve the debug endpoints, e.g. /debug/stack?id=<stackId>",
+			EnvVar:      "DEBUG_ENDPOINTS",
+			Destination: &debugEndpoints,
+		},
+		cli.StringFlag{
+			Name:        "debug_auth_user",
+			Usage:       "The basic auth user of the debug endpoints, along with debug_auth_password",
+			EnvVar:      "DEBUG_AUTH_USER",
+			Destination: &debugAuthUser,
+		},
+		cli.StringFlag{
+			Name:        "debug_auth_password",
+			Usage:       "The basic auth password of the debug endpoints, along with debug_auth_user",
+			EnvVar:      "DEBUG_AUTH_PASSWORD",
+			Destination: &debugAuthPassword,
+		},
+		cli.StringFlag{
+			Name:        "debug_auth_token",
+			Usage:       "The bearer token of the debug endpoints, instead of or besides the basic auth",
+			EnvVar:      "DEBUG_AUTH_TOKEN",
+			Destination: &debugAuthToken,
+		},
+		cli.Float64Flag{
+			Name:        "startup_ema_alpha",
+			Usage:       "The smoothing factor (0..1] of the average startup time of every service, higher follows the new instances faster, 0 means disabled",
+			EnvVar:      "STARTUP_EMA_ALPHA",
+			Destination: &startupEMAAlpha,
+		},
+		cli.BoolFlag{
+			Name:        "log_response_bodies",
+			Usage:       "Log the Rancher API response bodies at debug level with the secrets redacted",
+			EnvVar:      "LOG_RESPONSE_BODIES",
+			Destination: &logResponseBodies,
+		},
+		cli.IntFlag{
+			Name:        "max_log_body_bytes",
+			Usage:       "The maximum bytes of every response body logged when log_response_bodies is set, 0 means unlimited",
+			EnvVar:      "MAX_LOG_BODY_BYTES",
+			Value:       4096,
+			Destination: &maxLogBodyBytes,
+		},
+		cli.BoolFlag{
+			Name:        "use_base_units",
+			Usage:       "Expose the durations in seconds instead of milliseconds, e.g. rancher_instance_bootstrap_seconds instead of rancher_instance_bootstrap_ms",
+			EnvVar:      "USE_BASE_UNITS",
+			Destination: &useBaseUnits,
+		},
+		cli.IntFlag{
+			Name:        "stuck_threshold_seconds",
+			Usage:       "The seconds a stack may stay in a transitional state before counting as stuck, 0 means disabled",
+			EnvVar:      "STUCK_THRESHOLD_SECONDS",
+			Destination: &stuckThresholdSeconds,
+		},
+		cli.BoolFlag{
+			Name:        "service_self_link",
+			Usage:       "Expose the self link of every service in the Rancher API",
+			EnvVar:      "SERVICE_SELF_LINK",
+			Destination: &serviceSelfLink,
+		},
+		cli.BoolFlag{
+			Name:        "collect_lb_backends",
+			Usage:       "Emit the numbers of the healthy and total backends of the load balancers",
+			EnvVar:      "COLLECT_LB_BACKENDS",
+			Destination: &collectLBBackends,
+		},
+		cli.BoolFlag{
+			Name:        "collect_members",
+			Usage:       "Expose the member count of the environment, one more request per scrape",
+			EnvVar:      "COLLECT_MEMBERS",
+			Destination: &collectMembers,
+		},
+		cli.IntFlag{
+			Name:        "max_total_series",
+			Usage:       "The maximum number of the stack, service, instance and host series on every collect, the new series over it are dropped, 0 means unlimited",
+			EnvVar:      "MAX_TOTAL_SERIES",
+			Destination: &maxTotalSeries,
+		},
+		cli.BoolFlag{
+			Name:        "instance_metrics_system",
+			Usage:       "Emit the per-instance gauges of the system instances too, they are still counted by the service metrics otherwise",
+			EnvVar:      "INSTANCE_METRICS_SYSTEM",
+			Destination: &instanceMetricsSystem,
+		},
+		cli.BoolFlag{
+			Name:        "disable_compression",
+			Usage:       "Never gzip the metrics response, even if the scraper accepts it",
+			EnvVar:      "DISABLE_COMPRESSION",
+			Destination: &disableCompression,
+		},
+		cli.BoolFlag{
+			Name:        "canonical_type_labels",
+			Usage:       "Map the Rancher types of the type labels to the canonical ones, e.g. loadBalancerService to load_balancer",
+			EnvVar:      "CANONICAL_TYPE_LABELS",
+			Destination: &canonicalTypeLabels,
+		},
+		cli.StringFlag{
+			Name:        "type_label_overrides",
+			Usage:       "The comma separated type=label pairs overriding the canonical type labels, e.g. dnsService=alias",
+			EnvVar:      "TYPE_LABEL_OVERRIDES",
+			Destination: &typeLabelOverrides,
+		},
+		cli.StringFlag{
+			Name:        "host_label_selector",
+			Usage:       "Only collect the hosts having all the comma separated key=value labels, e.g. role=compute",
+			EnvVar:      "HOST_LABEL_SELECTOR",
+			Destination: &hostLabelSelectorFlag,
+		},
+		cli.StringFlag{
+			Name:        "host_label_keys",
+			Usage:       "The comma separated keys of the host labels exposed by rancher_host_labels, e.g. region,rack",
+			EnvVar:      "HOST_LABEL_KEYS",
+			Destination: &hostLabelKeysFlag,
+		},
+		cli.StringFlag{
+			Name:        "stack_include",
+			Usage:       "Only collect the stacks whose names match the regular expression, e.g. ^team-a-",
+			EnvVar:      "STACK_INCLUDE",
+			Destination: &stackIncludeFlag,
+		},
+		cli.StringFlag{
+			Name:        "stack_exclude",
+			Usage:       "Skip the stacks whose names match the regular expression, winning over stack_include",
+			EnvVar:      "STACK_EXCLUDE",
+			Destination: &stackExcludeFlag,
+		},
+		cli.StringFlag{
+			Name:        "environments",
+			Usage:       "The comma separated names or ids of the environments to collect, all the matching ones are collected, the first one of the API key otherwise",
+			EnvVar:      "ENVIRONMENTS",
+			Destination: &environmentsFlag,
+		},
+		cli.StringFlag{
+			Name:        "environment_credentials",
+			Usage:       "The comma separated id=access_key:secret_key API keys of the environments, e.g. 1a5=<access key>:<secret key>, the environments not listed use the cattle keys or token",
+			EnvVar:      "ENVIRONMENT_CREDENTIALS",
+			Destination: &environmentCredsFlag,
+		},
 	}
 
 	app.Run(os.Args)
@@ -105,15 +523,216 @@ func appAction(c *cli.Context) {
 		log.Level = logrus.InfoLevel
 	}
 
+	// tls
+	if tlsInsecure || len(caCertFile) != 0 {
+		tlsConfig, err := newTLSConfig(tlsInsecure, caCertFile)
+		if err != nil {
+			panic(err)
+		}
+		if tlsInsecure {
+			log.Warnln("Skipping the verification of the TLS certificate of Rancher API")
+		}
+
+		rancherTLSConfig = tlsConfig
+		rancherTransport = newRancherTransport(tlsConfig)
+	}
+
 	// cattle url
 	if cattleURL == "" {
 		panic(errors.New("cattle_url must be set and non-empty"))
 	} else {
-		cattleURL = strings.Replace(cattleURL, "/v1", "/v2-beta", -1)
+		serverURL, urlBase, projectPath := splitAPIBase(cattleURL)
 
-		if !strings.Contains(cattleURL, "/v2-beta") {
-			cattleURL += "/v2-beta"
+		// an API base given in the URL wins over the detection
+		apiBase := cattleAPIBase
+		if apiBase == "auto" && len(urlBase) != 0 {
+			apiBase = urlBase
+		} else if apiBase == "auto" {
+			var err error
+			if apiBase, err = detectAPIBase(serverURL); err != nil {
+				panic(errors.New("cannot detect the API base, set cattle_api_base to override it, " + err.Error()))
+			}
 		}
+
+		cattleURL = serverURL + "/" + strings.Trim(apiBase, "/") + projectPath
+		log.Infoln("Using the API base", apiBase)
+	}
+
+	// instance sample rate
+	if instanceSampleRate < 0 || instanceSampleRate > 1 {
+		panic(errors.New("instance_sample_rate must be between 0 and 1"))
+	}
+
+	// fetch engine
+	if fetchEngine != "nested" && fetchEngine != "flat" {
+		panic(errors.New("fetch_engine must be nested or flat"))
+	}
+
+	// startup ema alpha
+	if startupEMAAlpha < 0 || startupEMAAlpha > 1 {
+		panic(errors.New("startup_ema_alpha must be between 0 and 1"))
+	}
+
+	// adaptive interval
+	if adaptiveInterval {
+		if adaptiveIntervalMin <= 0 || adaptiveIntervalMax < adaptiveIntervalMin {
+			panic(errors.New("adaptive_interval_min must be positive and not above adaptive_interval_max"))
+		}
+		if adaptiveIntervalFactor < 1 {
+			panic(errors.New("adaptive_interval_factor must be at least 1"))
+		}
+	}
+
+	// scrape timeout
+	if err := validateScrapeTimeout(scrapeTimeout, pushInterval); err != nil {
+		panic(err)
+	}
+
+	// debug endpoints
+	if debugEndpoints && len(debugAuthToken) == 0 && (len(debugAuthUser) == 0 || len(debugAuthPassword) == 0) {
+		panic(errors.New("debug_endpoints requires debug_auth_token or both debug_auth_user and debug_auth_password"))
+	}
+
+	// max label length
+	if maxLabelLength > 0 && maxLabelLength < 16 {
+		panic(errors.New("max_label_length must be 0 or at least 16"))
+	}
+
+	// base units
+	if !useBaseUnits {
+		log.Warnln("The millisecond metrics are deprecated, set use_base_units to expose them in seconds")
+	}
+
+	// type labels
+	if canonicalTypeLabels {
+		typeLabels = make(map[string]string, len(canonicalTypes))
+		for rancherType, typeLabel := range canonicalTypes {
+			typeLabels[rancherType] = typeLabel
+		}
+
+		for _, override := range strings.Split(typeLabelOverrides, ",") {
+			if len(strings.TrimSpace(override)) == 0 {
+				continue
+			}
+
+			pair := strings.SplitN(override, "=", 2)
+			if len(pair) != 2 || len(strings.TrimSpace(pair[0])) == 0 || len(strings.TrimSpace(pair[1])) == 0 {
+				panic(errors.New("type_label_overrides must be comma separated type=label pairs"))
+			}
+			typeLabels[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+	}
+
+	// host label selector
+	for _, requirement := range strings.Split(hostLabelSelectorFlag, ",") {
+		if len(strings.TrimSpace(requirement)) == 0 {
+			continue
+		}
+
+		pair := strings.SplitN(requirement, "=", 2)
+		if len(pair) != 2 || len(strings.TrimSpace(pair[0])) == 0 {
+			panic(errors.New("host_label_selector must be comma separated key=value pairs"))
+		}
+		if hostLabelSelector == nil {
+			hostLabelSelector = make(map[string]string)
+		}
+		hostLabelSelector[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+
+	// host label keys
+	hostLabelNames := make(map[string]string, 4)
+	for _, key := range strings.Split(hostLabelKeysFlag, ",") {
+		if key = strings.TrimSpace(key); len(key) == 0 {
+			continue
+		}
+
+		if sameName, ok := hostLabelNames[hostLabelName(key)]; ok {
+			panic(errors.New("host_label_keys " + sameName + " and " + key + " map to the same label name"))
+		}
+		hostLabelNames[hostLabelName(key)] = key
+		hostLabelKeys = append(hostLabelKeys, key)
+	}
+	if len(hostLabelKeys) != 0 {
+		extendingHostLabels = newHostLabelsVec(hostLabelKeys)
+	}
+
+	// environments
+	for _, environment := range strings.Split(environmentsFlag, ",") {
+		if environment = strings.TrimSpace(environment); len(environment) == 0 {
+			continue
+		}
+
+		if environments == nil {
+			environments = make(map[string]bool)
+		}
+		environments[environment] = true
+	}
+
+	// environment credentials
+	for _, entry := range strings.Split(environmentCredsFlag, ",") {
+		if len(strings.TrimSpace(entry)) == 0 {
+			continue
+		}
+
+		pair := strings.SplitN(entry, "=", 2)
+		projectId := strings.TrimSpace(pair[0])
+		if len(pair) != 2 || len(projectId) == 0 || !strings.Contains(pair[1], ":") {
+			panic(errors.New("environment_credentials must be comma separated id=access_key:secret_key entries"))
+		}
+		if environmentCredentials == nil {
+			environmentCredentials = make(map[string]string)
+		}
+		environmentCredentials[projectId] = strings.TrimSpace(pair[1])
+	}
+
+	// stack filters
+	if len(stackIncludeFlag) != 0 {
+		pattern, err := regexp.Compile(stackIncludeFlag)
+		if err != nil {
+			panic(errors.New("stack_include must be a regular expression: " + err.Error()))
+		}
+		stackInclude = pattern
+	}
+	if len(stackExcludeFlag) != 0 {
+		pattern, err := regexp.Compile(stackExcludeFlag)
+		if err != nil {
+			panic(errors.New("stack_exclude must be a regular expression: " + err.Error()))
+		}
+		stackExclude = pattern
+	}
+
+	// retry
+	if retryMax < 0 {
+		panic(errors.New("retry_max must not be negative"))
+	}
+	if retryMax > 0 && retryBackoffMs <= 0 {
+		panic(errors.New("retry_backoff_ms must be positive"))
+	}
+	retryBackoff = time.Duration(retryBackoffMs) * time.Millisecond
+
+	// max pages
+	if maxPages < 0 {
+		panic(errors.New("rancher_max_pages must not be negative"))
+	}
+
+	// request limiter
+	if maxConcurrency > 0 {
+		requestLimiter = make(chan struct{}, maxConcurrency)
+		fetchLimiter = make(chan struct{}, maxConcurrency)
+	}
+
+	// probe limiter
+	if probeConcurrency < 1 {
+		panic(errors.New("probe_concurrency must be positive"))
+	}
+
+	// request rate limiter
+	if rancherRPS > 0 {
+		if rancherBurst < 1 {
+			panic(errors.New("rancher_burst must be positive"))
+		}
+		requestRateLimiter = rate.NewLimiter(rate.Limit(rancherRPS), rancherBurst)
+		log.Infoln("Limiting Rancher API to", rancherRPS, "requests per second, with burst", rancherBurst)
 	}
 
 	log.Infoln("Starting rancher_exporter", version.Info(), ", with cattle URL: ", cattleURL, ", access key: ", cattleAccessKey, ", system services hidden: ", hideSys)
@@ -124,11 +743,68 @@ func appAction(c *cli.Context) {
 	// register exporter
 	prometheus.MustRegister(re)
 	prometheus.MustRegister(version.NewCollector("rancher_exporter"))
+	if metadataURL != "" {
+		log.Infoln("Collecting from metadata service", metadataURL)
+		prometheus.MustRegister(newMetadataExporter(metadataURL, re))
+	}
+
+	// start push
+	if pushgatewayURL != "" {
+		lastFetch := prometheus.NewRegistry()
+		lastFetch.MustRegister(newLastFetchExporter(re))
+		lastFetch.MustRegister(version.NewCollector("rancher_exporter"))
+		if metadataURL != "" {
+			lastFetch.MustRegister(newMetadataExporter(metadataURL, re))
+		}
+
+		log.Infoln("Pushing to", pushgatewayURL, "after every fetch, at least every", pushInterval)
+		go pushMetrics(re, lastFetch, stopChan)
+	}
 
 	// start web
 	log.Infoln("Listening on", listenAddress)
-	http.Handle(metricPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	log.Fatal(http.ListenAndServe(listenAddress, newHandler(re, prometheus.DefaultGatherer)))
+
+	re.Stop()
+}
+
+// newHandler routes the metrics of the gatherer, filtered on collect[], and the other endpoints of the exporter.
+func newHandler(re *rancherExporter, gatherer prometheus.Gatherer) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	handlerOpts := promhttp.HandlerOpts{DisableCompression: disableCompression}
+	metricHandler := promhttp.HandlerFor(gatherer, handlerOpts)
+	mux.HandleFunc(metricPath, func(w http.ResponseWriter, req *http.Request) {
+		collects := req.URL.Query()["collect[]"]
+		if len(collects) == 0 {
+			metricHandler.ServeHTTP(w, req)
+			return
+		}
+
+		fe, err := newFilteredExporter(re, collects)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(fe)
+		promhttp.HandlerFor(registry, handlerOpts).ServeHTTP(w, req)
+	})
+	if debugEndpoints {
+		mux.HandleFunc("/debug/stack", requireDebugAuth(re.serveDebugStack))
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if !re.ready() {
+			http.Error(w, "no successful fetch from Rancher yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>Rancher 1.6 Exporter</title></head>
              <body>
@@ -137,7 +813,86 @@ func appAction(c *cli.Context) {
              </body>
              </html>`))
 	})
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
 
-	re.Stop()
+	return mux
+}
+
+// newTLSConfig verifies the TLS certificate of Rancher API with the CA certificates of the PEM file, if any, or not at all when insecure.
+func newTLSConfig(insecure bool, caCertFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(caCertFile) != 0 {
+		caCertBytes, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, errors.New("cannot read ca_cert_file, " + err.Error())
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCertBytes) {
+			return nil, errors.New("ca_cert_file must contain PEM certificates")
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// validateScrapeTimeout checks that a scrape fits in the push interval.
+func validateScrapeTimeout(scrapeTimeout, pushInterval time.Duration) error {
+	if scrapeTimeout <= 0 {
+		return errors.New("scrape_timeout must be positive")
+	}
+	if pushInterval <= 0 {
+		return errors.New("push_interval must be positive")
+	}
+	if scrapeTimeout >= pushInterval {
+		return errors.New("scrape_timeout must be below push_interval, the pushes would queue behind the fetches otherwise")
+	}
+
+	return nil
+}
+
+// splitAPIBase cuts the API base out of the URL, e.g. v2-beta, keeping the path after it, e.g. /projects/1a5.
+func splitAPIBase(cattleURL string) (string, string, string) {
+	cattleURL = strings.TrimSuffix(cattleURL, "/")
+
+	for _, base := range []string{"v2-beta", "v1"} {
+		if idx := strings.Index(cattleURL+"/", "/"+base+"/"); idx >= 0 {
+			return cattleURL[:idx], base, cattleURL[idx+len(base)+1:]
+		}
+	}
+
+	return cattleURL, "", ""
+}
+
+// pushMetrics pushes the metrics of every fetch from Rancher, and fetches on its own when no scrape has fetched
+// within a push interval.
+func pushMetrics(re *rancherExporter, lastFetch prometheus.Gatherer, stopChan <-chan interface{}) {
+	ticker := time.NewTicker(pushInterval)
+	defer ticker.Stop()
+
+	fetched := false
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-re.fetched:
+			fetched = true
+		case <-ticker.C:
+			if fetched {
+				fetched = false
+				continue
+			}
+
+			// the fetch signals itself, take it back not to push it twice
+			re.fetch()
+			select {
+			case <-re.fetched:
+			default:
+			}
+		}
+
+		if err := push.FromGatherer(pushJob, push.HostnameGroupingKey(), pushgatewayURL, lastFetch); err != nil {
+			exporterPushErrors.Inc()
+			log.Warnln("cannot push metrics,", err)
+		}
+	}
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	/**
+		Metadata
+	 */
+
+	metadataServicesScale = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "metadata",
+		Name:      "service_scale",
+		Help:      "scale of defined service as reported by Rancher metadata service",
+	}, []string{"name", "stack_name", "system", "type"})
+
+	metadataServicesContainers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "metadata",
+		Name:      "service_containers",
+		Help:      "Current number of the containers of defined service as reported by Rancher metadata service",
+	}, []string{"name", "stack_name", "state", "health_state"})
+
+	metadataServicesScaleMismatch = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "metadata",
+		Name:      "service_scale_mismatch",
+		Help:      "Whether the scale of defined service reported by Rancher metadata service differs from the one of Rancher API",
+	}, []string{"name", "stack_name", "system"})
+)
+
+// metadataService names a service the same as the labels of the service scale gauges.
+type metadataService struct {
+	name      string
+	stackName string
+	system    string
+}
+
+/**
+	MetadataExporter
+ */
+type metadataExporter struct {
+	metadataURL string
+	mutex       *sync.Mutex
+	client      *http.Client
+	exporter    *rancherExporter
+}
+
+func (m *metadataExporter) Describe(ch chan<- *prometheus.Desc) {
+	metadataServicesScale.Describe(ch)
+	metadataServicesContainers.Describe(ch)
+	metadataServicesScaleMismatch.Describe(ch)
+}
+
+func (m *metadataExporter) Collect(ch chan<- prometheus.Metric) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorln(err)
+		}
+	}()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	metadataServicesScale.Reset()
+	metadataServicesContainers.Reset()
+	metadataServicesScaleMismatch.Reset()
+
+	scales := make(map[metadataService]float64, 32)
+	if servicesRespBytes, err := m.get("/services"); err != nil {
+		log.Warnln(err)
+	} else {
+		jsonparser.ArrayEach(servicesRespBytes, func(serviceBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+			serviceSystem, _ := jsonparser.GetBoolean(serviceBytes, "system")
+			service := metadataService{
+				name:      getLabel(serviceBytes, "name"),
+				stackName: getLabel(serviceBytes, "stack_name"),
+				system:    strconv.FormatBool(serviceSystem),
+			}
+			serviceKind, _ := jsonparser.GetString(serviceBytes, "kind")
+			serviceScale, _ := jsonparser.GetInt(serviceBytes, "scale")
+
+			scales[service] = float64(serviceScale)
+			metadataServicesScale.WithLabelValues(service.name, service.stackName, service.system, typeLabel(serviceKind)).Set(float64(serviceScale))
+		})
+	}
+
+	// cross-check the scales with the last fetch from Rancher API, for the services known to both of them
+	if m.exporter != nil && len(scales) != 0 {
+		m.exporter.mutex.Lock()
+		apiScales := gatherMetrics(infinityWorksServicesScale)
+		m.exporter.mutex.Unlock()
+
+		for _, metric := range apiScales {
+			pb := &dto.Metric{}
+			if err := metric.Write(pb); err != nil {
+				continue
+			}
+
+			labels := make(map[string]string, len(pb.GetLabel()))
+			for _, labelPair := range pb.GetLabel() {
+				labels[labelPair.GetName()] = labelPair.GetValue()
+			}
+			service := metadataService{labels["name"], labels["stack_name"], labels["system"]}
+			if scale, ok := scales[service]; !ok {
+				continue
+			} else if scale != pb.GetGauge().GetValue() {
+				metadataServicesScaleMismatch.WithLabelValues(service.name, service.stackName, service.system).Set(1)
+			} else {
+				metadataServicesScaleMismatch.WithLabelValues(service.name, service.stackName, service.system).Set(0)
+			}
+		}
+	}
+
+	if containersRespBytes, err := m.get("/containers"); err != nil {
+		log.Warnln(err)
+	} else {
+		jsonparser.ArrayEach(containersRespBytes, func(containerBytes []byte, dataType jsonparser.ValueType, offset int, err error) {
+			containerStackName := getLabel(containerBytes, "stack_name")
+			containerServiceName := getLabel(containerBytes, "service_name")
+			containerState, _ := jsonparser.GetString(containerBytes, "state")
+			containerHealthState, _ := jsonparser.GetString(containerBytes, "health_state")
+
+			// standalone containers do not belong to any service
+			if len(containerServiceName) == 0 {
+				return
+			}
+
+			metadataServicesContainers.WithLabelValues(containerServiceName, containerStackName, containerState, containerHealthState).Inc()
+		})
+	}
+
+	metadataServicesScale.Collect(ch)
+	metadataServicesContainers.Collect(ch)
+	metadataServicesScaleMismatch.Collect(ch)
+}
+
+func (m *metadataExporter) get(path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", m.metadataURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the metadata service answers plain text unless asking for json
+	req.Header.Set("Accept", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &statusError{resp.StatusCode, bs}
+	}
+
+	return bs, nil
+}
+
+// newMetadataExporter collects from the metadata service, cross-checking the scales with the fetches of the exporter.
+func newMetadataExporter(metadataURL string, exporter *rancherExporter) *metadataExporter {
+	return &metadataExporter{
+		metadataURL: strings.TrimSuffix(metadataURL, "/"),
+		mutex:       &sync.Mutex{},
+		client:      &http.Client{Timeout: 10 * time.Second},
+		exporter:    exporter,
+	}
+}